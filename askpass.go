@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// askMutex serializes the prompts of the workers.
+var askMutex sync.Mutex
+
+// AskSecret asks a secret with PROMPT on the terminal.  If the standard
+// input is not a terminal, e.g. it has the input of the commands, /dev/tty
+// or the program of SSH_ASKPASS is used instead, like ssh(1).
+// SSH_ASKPASS_REQUIRE is either "force" to use SSH_ASKPASS always, or
+// "never" not to use it.
+func AskSecret(prompt string) (string, error) {
+	return ask(prompt, false)
+}
+
+// AskLine asks a line with PROMPT like AskSecret(), but the input is
+// echoed, e.g. for the user name.
+func AskLine(prompt string) (string, error) {
+	return ask(prompt, true)
+}
+
+// TellUser writes MESSAGE to the user, e.g. the instruction of a server,
+// without mixing it with the prompts of the other workers.
+func TellUser(message string) {
+	askMutex.Lock()
+	defer askMutex.Unlock()
+	fmt.Fprintf(os.Stderr, "%s\n", message)
+}
+
+func ask(prompt string, echo bool) (string, error) {
+	suspendHandshakes()
+	defer resumeHandshakes()
+
+	askMutex.Lock()
+	defer askMutex.Unlock()
+
+	askpass := os.Getenv("SSH_ASKPASS")
+	require := os.Getenv("SSH_ASKPASS_REQUIRE")
+	if require == "never" {
+		askpass = ""
+	}
+	if askpass != "" && require == "force" {
+		return runAskPass(askpass, prompt)
+	}
+
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		return readSecret(int(syscall.Stdin), os.Stderr, prompt, echo)
+	}
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		if terminal.IsTerminal(int(tty.Fd())) {
+			return readSecret(int(tty.Fd()), tty, prompt, echo)
+		}
+	}
+
+	if askpass != "" {
+		return runAskPass(askpass, prompt)
+	}
+	return "", fmt.Errorf("no terminal to ask, and SSH_ASKPASS is not set")
+}
+
+// handshakes has the connections in the SSH handshake and their timeouts.
+// Since the secrets are asked in the middle of the handshakes, e.g. the
+// passphrase of a key that a server accepted, the deadlines are cleared
+// while a secret is asked, and set again with the full timeout after it.
+var handshakes = struct {
+	sync.Mutex
+	conns  map[net.Conn]time.Duration
+	asking int
+}{conns: make(map[net.Conn]time.Duration)}
+
+// startHandshake sets the deadline of CONN to TIMEOUT from now, unless a
+// secret is being asked.  No deadline is set if TIMEOUT is zero.
+func startHandshake(conn net.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	handshakes.Lock()
+	defer handshakes.Unlock()
+
+	handshakes.conns[conn] = timeout
+	if handshakes.asking == 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// endHandshake clears the deadline of CONN.
+func endHandshake(conn net.Conn) {
+	handshakes.Lock()
+	defer handshakes.Unlock()
+
+	delete(handshakes.conns, conn)
+	conn.SetDeadline(time.Time{})
+}
+
+func suspendHandshakes() {
+	handshakes.Lock()
+	defer handshakes.Unlock()
+
+	handshakes.asking++
+	if handshakes.asking == 1 {
+		for conn := range handshakes.conns {
+			conn.SetDeadline(time.Time{})
+		}
+	}
+}
+
+func resumeHandshakes() {
+	handshakes.Lock()
+	defer handshakes.Unlock()
+
+	handshakes.asking--
+	if handshakes.asking == 0 {
+		for conn, timeout := range handshakes.conns {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+	}
+}
+
+// readSecret reads a line from the terminal FD without echo unless ECHO is
+// true, after writing PROMPT to OUT.
+func readSecret(fd int, out io.Writer, prompt string, echo bool) (string, error) {
+	fmt.Fprintf(out, "%s", prompt)
+	if echo {
+		return readLine(fd)
+	}
+	secret, err := terminal.ReadPassword(fd)
+	fmt.Fprintf(out, "\n")
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// readLine reads a line from FD byte by byte, so that nothing after the
+// line is consumed.
+func readLine(fd int) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(line) == 0 {
+			return "", io.EOF
+		}
+		break
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// runAskPass runs PROGRAM with PROMPT, and returns the first line of its
+// output.
+func runAskPass(program string, prompt string) (string, error) {
+	out, err := exec.Command(program, prompt).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s", program, err)
+	}
+	return strings.TrimRight(strings.SplitN(string(out), "\n", 2)[0], "\r"), nil
+}
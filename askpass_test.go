@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAskPass_SuspendHandshakes(env *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	timeout := time.Duration(100) * time.Millisecond
+	startHandshake(client, timeout)
+	defer endHandshake(client)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	suspendHandshakes()
+	select {
+	case err := <-done:
+		env.Fatalf("the deadline should be cleared while asking: %v", err)
+	case <-time.After(3 * timeout):
+	}
+
+	resumeHandshakes()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			env.Errorf("expected timeout, got %v", err)
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		env.Errorf("the deadline should be set again after asking")
+	}
+}
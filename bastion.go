@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_BASTION_MAX_CHANNELS = 10
+
+// BastionConn is a shared connection to a bastion server.
+type BastionConn struct {
+	Client *ssh.Client
+
+	key      string
+	channels int  // number of jobs that are using this connection
+	closed   bool // true if the connection was dropped
+}
+
+// BastionPool keeps authenticated connections to the bastion servers so
+// that all jobs share them, instead of doing the handshake per job.  For a
+// chain of bastions, a connection is made to the last bastion through the
+// earlier ones, and it is shared as a whole.  Each connection carries at
+// most MaxChannels jobs at a time; more connections are made when all of
+// them are busy.  A connection that was dropped is replaced on the next
+// Acquire().
+type BastionPool struct {
+	MaxChannels int
+
+	dial    func(hops []SshHop) (*ssh.Client, error)
+	mutex   sync.Mutex
+	conns   map[string][]*BastionConn
+	dialing map[string]*bastionDial
+}
+
+// bastionDial is a dialing in progress, which the other jobs for the same
+// bastion wait for.
+type bastionDial struct {
+	done chan struct{} // closed when the dialing ends
+	err  error         // the error of the dialing, set before done is closed
+}
+
+func NewBastionPool(maxChannels int, dial func([]SshHop) (*ssh.Client, error)) *BastionPool {
+	if maxChannels <= 0 {
+		maxChannels = DEFAULT_BASTION_MAX_CHANNELS
+	}
+	return &BastionPool{MaxChannels: maxChannels, dial: dial, conns: make(map[string][]*BastionConn), dialing: make(map[string]*bastionDial)}
+}
+
+// Acquire returns a connection to the last bastion of HOPS.  The caller
+// must call Release() when it no longer uses the connection.
+func (p *BastionPool) Acquire(hops []SshHop) (*BastionConn, error) {
+	key := BastionChain(hops)
+
+	p.mutex.Lock()
+	for {
+		for _, c := range p.conns[key] {
+			if !c.closed && c.channels < p.MaxChannels {
+				c.channels++
+				p.mutex.Unlock()
+				return c, nil
+			}
+		}
+
+		// The jobs waiting for the same bastion reuse the new connection
+		// instead of making their own, and fail together if the dialing
+		// fails.
+		wait, ok := p.dialing[key]
+		if !ok {
+			break
+		}
+		p.mutex.Unlock()
+		<-wait.done
+		if wait.err != nil {
+			return nil, wait.err
+		}
+		p.mutex.Lock()
+	}
+
+	dialing := &bastionDial{done: make(chan struct{})}
+	p.dialing[key] = dialing
+	l.Debug("BastionPool: connecting to %s (%d connection(s) in use)", key, len(p.conns[key]))
+	p.mutex.Unlock()
+
+	// the lock is released while dialing, so that the other bastions are
+	// not blocked by the handshake
+	client, err := p.dial(hops)
+
+	p.mutex.Lock()
+	delete(p.dialing, key)
+	dialing.err = err
+	close(dialing.done)
+	if err != nil {
+		p.mutex.Unlock()
+		return nil, err
+	}
+
+	c := &BastionConn{Client: client, key: key, channels: 1}
+	p.conns[key] = append(p.conns[key], c)
+	p.mutex.Unlock()
+
+	go func() {
+		err := client.Wait()
+		l.Debug("BastionPool: connection to %s closed: %v", key, err)
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		c.closed = true
+		p.prune(key)
+	}()
+
+	return c, nil
+}
+
+// BastionChain returns the string representation of HOPS, which is used as
+// the key of the pool.
+func BastionChain(hops []SshHop) string {
+	endpoints := []string{}
+	for _, hop := range hops {
+		endpoints = append(endpoints, fmt.Sprintf("%s@%s", hop.Config.User, hop.Address))
+	}
+	return strings.Join(endpoints, ",")
+}
+
+// Dial opens a connection to ADDR through the bastion connection C.  If
+// the bastion connection turns out to be dropped, it will not be used for
+// the later jobs.
+func (p *BastionPool) Dial(c *BastionConn, addr string) (net.Conn, error) {
+	conn, err := c.Client.Dial("tcp", addr)
+	if err != nil {
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			// the channel was not rejected by the bastion, which means
+			// that the connection itself is not usable.
+			p.mutex.Lock()
+			c.closed = true
+			p.mutex.Unlock()
+			c.Client.Close()
+		}
+	}
+	return conn, err
+}
+
+// Connect acquires a connection to the last bastion of HOPS, and opens a
+// connection to ADDR through it.  If the bastion connection turns out to
+// be dropped, it is replaced once.  The caller must call Release() with
+// the returned bastion connection when it no longer uses it.
+func (p *BastionPool) Connect(hops []SshHop, addr string) (*BastionConn, net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		c, err := p.Acquire(hops)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := p.Dial(c, addr)
+		if err == nil {
+			return c, conn, nil
+		}
+		p.Release(c)
+
+		p.mutex.Lock()
+		dropped := c.closed
+		p.mutex.Unlock()
+		if !dropped || attempt > 1 {
+			return nil, nil, err
+		}
+		l.Debug("BastionPool: connection to %s dropped, reconnecting: %v", c.key, err)
+	}
+}
+
+func (p *BastionPool) Release(c *BastionConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	c.channels--
+	p.prune(c.key)
+}
+
+// prune removes dropped connections that are not used by any job.
+func (p *BastionPool) prune(key string) {
+	conns := p.conns[key][:0]
+	for _, c := range p.conns[key] {
+		if c.closed && c.channels <= 0 {
+			continue
+		}
+		conns = append(conns, c)
+	}
+	if len(conns) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = conns
+	}
+}
+
+func (p *BastionPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, conns := range p.conns {
+		for _, c := range conns {
+			c.closed = true
+			c.Client.Close()
+		}
+		delete(p.conns, key)
+	}
+}
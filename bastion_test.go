@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSshServer is a minimal SSH server that accepts any client without
+// authentication.  It only supports "direct-tcpip" channels.
+type testSshServer struct {
+	Listener net.Listener
+	Config   *ssh.ServerConfig
+
+	mutex sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newTestSshServer(env *testing.T) *testSshServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		env.Fatalf("cannot generate a key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		env.Fatalf("cannot create a signer: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+
+	server := &testSshServer{Listener: listener, Config: &ssh.ServerConfig{NoClientAuth: true}}
+	server.Config.AddHostKey(signer)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				server.mutex.Lock()
+				config := server.Config
+				server.mutex.Unlock()
+
+				sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				server.mutex.Lock()
+				server.conns = append(server.conns, sc)
+				server.mutex.Unlock()
+
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					if ch.ChannelType() != "direct-tcpip" {
+						ch.Reject(ssh.UnknownChannelType, "not supported")
+						continue
+					}
+					go forwardTestChannel(ch)
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func forwardTestChannel(ch ssh.NewChannel) {
+	var req struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(ch.ExtraData(), &req); err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := ch.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(channel, conn)
+		channel.Close()
+		conn.Close()
+	}()
+	io.Copy(conn, channel)
+	closeWrite(conn)
+}
+
+// Configure calls F to change the configuration of the running server.
+func (s *testSshServer) Configure(f func(config *ssh.ServerConfig)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(s.Config)
+}
+
+func (s *testSshServer) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+// DropAll closes all connections from the server side.
+func (s *testSshServer) DropAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSshServer) Close() {
+	s.Listener.Close()
+	s.DropAll()
+}
+
+func testClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		Timeout:         time.Duration(5) * time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+func TestBastionPool_SharesConnections(env *testing.T) {
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	dialed := 0
+	pool := NewBastionPool(2, func(hops []SshHop) (*ssh.Client, error) {
+		dialed++
+		return ssh.Dial("tcp", hops[0].Address, hops[0].Config)
+	})
+	defer pool.Close()
+
+	hops := []SshHop{{Address: server.Addr(), Config: testClientConfig()}}
+
+	c1, err := pool.Acquire(hops)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	c2, _ := pool.Acquire(hops)
+	c3, _ := pool.Acquire(hops)
+
+	if c1 != c2 {
+		env.Errorf("the first two jobs should share the connection")
+	}
+	if c1 == c3 {
+		env.Errorf("the third job should not exceed MaxChannels")
+	}
+	if dialed != 2 {
+		env.Errorf("expected 2 connections, got %d", dialed)
+	}
+
+	pool.Release(c1)
+	c4, _ := pool.Acquire(hops)
+	if c4 != c1 && c4 != c3 {
+		env.Errorf("released channel should be reused")
+	}
+	if dialed != 2 {
+		env.Errorf("expected 2 connections, got %d", dialed)
+	}
+}
+
+func TestBastionPool_Reconnects(env *testing.T) {
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	dialed := 0
+	pool := NewBastionPool(10, func(hops []SshHop) (*ssh.Client, error) {
+		dialed++
+		return ssh.Dial("tcp", hops[0].Address, hops[0].Config)
+	})
+	defer pool.Close()
+
+	hops := []SshHop{{Address: server.Addr(), Config: testClientConfig()}}
+
+	c1, err := pool.Acquire(hops)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	pool.Release(c1)
+
+	server.DropAll()
+	c1.Client.Wait()
+
+	// wait for the pool to notice the dropped connection
+	for i := 0; i < 100; i++ {
+		pool.mutex.Lock()
+		closed := c1.closed
+		pool.mutex.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	c2, err := pool.Acquire(hops)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	if c1 == c2 || dialed != 2 {
+		env.Errorf("dropped connection should be replaced (dialed = %d)", dialed)
+	}
+}
+
+func TestBastionPool_DialsWithoutLock(env *testing.T) {
+	slow := newTestSshServer(env)
+	defer slow.Close()
+	fast := newTestSshServer(env)
+	defer fast.Close()
+
+	var mutex sync.Mutex
+	dialed := 0
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	pool := NewBastionPool(10, func(hops []SshHop) (*ssh.Client, error) {
+		if hops[0].Address == slow.Addr() {
+			mutex.Lock()
+			dialed++
+			mutex.Unlock()
+			started <- struct{}{}
+			<-release
+		}
+		return ssh.Dial("tcp", hops[0].Address, hops[0].Config)
+	})
+	defer pool.Close()
+
+	slowHops := []SshHop{{Address: slow.Addr(), Config: testClientConfig()}}
+	fastHops := []SshHop{{Address: fast.Addr(), Config: testClientConfig()}}
+
+	conns := make(chan *BastionConn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := pool.Acquire(slowHops)
+			if err != nil {
+				env.Errorf("unexpected error: %v", err)
+			}
+			conns <- c
+		}()
+	}
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Acquire(fastHops)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			env.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		env.Errorf("dialing a bastion blocks the other bastions")
+	}
+
+	close(release)
+	c1, c2 := <-conns, <-conns
+	if c1 == nil || c1 != c2 {
+		env.Errorf("the jobs waiting for the same bastion should share the connection")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if dialed != 1 {
+		env.Errorf("expected 1 connection, got %d", dialed)
+	}
+}
+
+func TestBastionPool_SharesDialError(env *testing.T) {
+	var mutex sync.Mutex
+	dialed := 0
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	pool := NewBastionPool(10, func(hops []SshHop) (*ssh.Client, error) {
+		mutex.Lock()
+		dialed++
+		mutex.Unlock()
+		started <- struct{}{}
+		<-release
+		return nil, errors.New("unreachable")
+	})
+	defer pool.Close()
+
+	hops := []SshHop{{Address: "bastion:22", Config: testClientConfig()}}
+
+	errs := make(chan error, 4)
+	go func() {
+		_, err := pool.Acquire(hops)
+		errs <- err
+	}()
+	<-started
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := pool.Acquire(hops)
+			errs <- err
+		}()
+	}
+	// let the other jobs wait for the dialing
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err == nil || err.Error() != "unreachable" {
+			env.Errorf("expected the dial error, got %v", err)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if dialed != 1 {
+		env.Errorf("the jobs waiting for the failed dialing should not dial again (dialed = %d)", dialed)
+	}
+}
+
+func TestBastionPool_ConnectRedials(env *testing.T) {
+	server := newTestSshServer(env)
+	defer server.Close()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+	defer target.Close()
+
+	dialed := 0
+	pool := NewBastionPool(10, func(hops []SshHop) (*ssh.Client, error) {
+		dialed++
+		return ssh.Dial("tcp", hops[0].Address, hops[0].Config)
+	})
+	defer pool.Close()
+
+	hops := []SshHop{{Address: server.Addr(), Config: testClientConfig()}}
+
+	c1, err := pool.Acquire(hops)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	pool.Release(c1)
+
+	// drop the connection before the pool notices it
+	c1.Client.Conn.Close()
+
+	c2, conn, err := pool.Connect(hops, target.Addr().String())
+	if err != nil {
+		env.Fatalf("dropped connection should be replaced: %v", err)
+	}
+	conn.Close()
+	pool.Release(c2)
+	if c1 == c2 || dialed != 2 {
+		env.Errorf("dropped connection should be replaced (dialed = %d)", dialed)
+	}
+}
+
+func TestSshSession_DialBastions(env *testing.T) {
+	gateway := newTestSshServer(env)
+	defer gateway.Close()
+	bastion := newTestSshServer(env)
+	defer bastion.Close()
+	target := newTestSshServer(env)
+	defer target.Close()
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	hops := []SshHop{
+		{Address: gateway.Addr(), Config: testClientConfig()},
+		{Address: bastion.Addr(), Config: testClientConfig()},
+	}
+	client, err := s.dialBastions(hops)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	conn, err := client.Dial("tcp", target.Addr())
+	if err != nil {
+		env.Fatalf("cannot dial through the bastions: %v", err)
+	}
+	tc, err := newClientConn(conn, target.Addr(), testClientConfig())
+	if err != nil {
+		env.Fatalf("cannot connect through the bastions: %v", err)
+	}
+	tc.Close()
+
+	client.Close()
+
+	// closing the last hop should close the connection to the gateway
+	gateway.mutex.Lock()
+	sc := gateway.conns[0]
+	gateway.mutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- sc.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(5) * time.Second):
+		env.Errorf("the connection to the gateway is not closed")
+	}
+}
@@ -29,18 +29,29 @@ type TsshConfig struct {
 
 	ServerNames []string // each element has the form 'name == "machine name"'
 
-	BastionUser    string
-	BastionName    string // Triton instance name
-	BastionPort    int
-	BastionAddress string
+	Bastions []BastionHop // ordered from the nearest bastion
+
+	BastionMaxChannels int // max concurrent jobs per bastion connection
 
 	ForceBastionOnPublicHost bool
 
-	Deadline time.Duration // time.Duration
-	Timeout  time.Duration // time.Duration
+	HostKeyPolicy HostKeyPolicy
+	RepinHostKeys bool
+
+	Timeout           time.Duration // connection timeout
+	CommandTimeout    time.Duration // max running time of a command, 0 for no limit
+	IdleTimeout       time.Duration // max time without input/output of a command, 0 for no limit
+	KeepaliveInterval time.Duration // 0 to disable keepalives
+
+	Retries      int           // number of retries of the connection
+	RetryBackoff time.Duration // delay before the first retry
 
 	InlineOutput     bool
 	InlineStdoutOnly bool
+	GroupOutput      bool  // print each distinct output once, after all hosts finished
+	MaxOutput        int64 // max bytes of the captured output per host, 0 for no limit
+	StreamOutput     bool
+	OutputFormat     OutputFormat
 
 	OutDirectory string
 	ErrDirectory string
@@ -48,6 +59,23 @@ type TsshConfig struct {
 
 	DefaultUser string
 
+	Env []EnvVar // environment variables for the remote commands
+
+	ScriptFile  string // the local script to run instead of COMMAND
+	Interpreter string // the program to run ScriptFile
+
+	Sudo             bool   // run the commands with sudo(8)
+	SudoUser         string // the user that sudo runs the commands as; root if empty
+	SudoPasswordFile string // the file that has the sudo password
+	sudoOnce         sync.Once
+	sudoPassword     string
+	sudoError        error
+
+	ListenAddress string // local address of the listeners in tunnel and socks mode
+	HttpConnect   bool   // accept HTTP CONNECT in socks mode
+
+	OutputFile string // the file that ssh-config mode writes to; stdout if empty
+
 	AskPassword  bool
 	askOnce      sync.Once
 	passwordAuth ssh.AuthMethod
@@ -59,23 +87,45 @@ type TsshConfig struct {
 	ImageCacheExpiration    time.Duration
 	InstanceCacheExpiration time.Duration
 
+	RunMode   RunMode
 	PrintMode PrintConfMode
+	Login     bool
 
 	DryRun bool
 
 	InstanceLimits uint64
 }
 
+// BastionHop is one of the bastion servers that the connections to the
+// instances go through.
+type BastionHop struct {
+	User    string
+	Name    string // Triton instance name
+	Port    int
+	Address string
+	ID      string // Triton instance ID of the bastion
+}
+
+func (hop BastionHop) String() string {
+	if hop.User == "" {
+		return fmt.Sprintf("%s:%d", hop.Name, hop.Port)
+	}
+	return fmt.Sprintf("%s@%s:%d", hop.User, hop.Name, hop.Port)
+}
+
 var Config TsshConfig = TsshConfig{
-	BastionUser: "root",
-	BastionPort: 22,
+	BastionMaxChannels: DEFAULT_BASTION_MAX_CHANNELS,
 
 	ServerPort: 22,
 
 	InlineOutput: false,
 
-	Timeout:  time.Duration(10) * time.Second,
-	Deadline: time.Duration(20) * time.Second,
+	Timeout:           time.Duration(10) * time.Second,
+	KeepaliveInterval: DEFAULT_KEEPALIVE_INTERVAL,
+
+	RetryBackoff: time.Duration(1) * time.Second,
+
+	ListenAddress: DEFAULT_LISTEN_ADDRESS,
 
 	Parallelism: runtime.NumCPU(),
 	DefaultUser: "root",
@@ -98,6 +148,7 @@ var NetworkQueryMaxTries = 2
 
 var ImgCache *ImageCache
 var NetCache *NetworkCache
+var HostKeys *KnownHosts
 
 const VERSION_STRING = "1.0.5"
 const UNKNOWN_TRITON_PROFILE = "__unknown__"
@@ -159,13 +210,18 @@ func (config TsshConfig) String() string {
 	buf.WriteString(fmt.Sprintf("TritonURL=%s, ", config.TritonURL))
 	buf.WriteString(fmt.Sprintf("User=%s, ", config.User))
 	buf.WriteString(fmt.Sprintf("ServerPort=%d, ", config.ServerPort))
-	buf.WriteString(fmt.Sprintf("BastionUser=%s, ", config.BastionUser))
-	buf.WriteString(fmt.Sprintf("BastionName=%s, ", config.BastionName))
-	buf.WriteString(fmt.Sprintf("BastionPort=%d, ", config.BastionPort))
-	buf.WriteString(fmt.Sprintf("Deadline=%v, ", config.Deadline))
+	buf.WriteString(fmt.Sprintf("Bastions=%v, ", config.Bastions))
+	buf.WriteString(fmt.Sprintf("HostKeyPolicy=%v, ", config.HostKeyPolicy))
 	buf.WriteString(fmt.Sprintf("Timeout=%s, ", config.Timeout))
+	buf.WriteString(fmt.Sprintf("CommandTimeout=%v, ", config.CommandTimeout))
+	buf.WriteString(fmt.Sprintf("IdleTimeout=%v, ", config.IdleTimeout))
+	buf.WriteString(fmt.Sprintf("KeepaliveInterval=%v, ", config.KeepaliveInterval))
+	buf.WriteString(fmt.Sprintf("Retries=%d, ", config.Retries))
+	buf.WriteString(fmt.Sprintf("RetryBackoff=%v, ", config.RetryBackoff))
 	buf.WriteString(fmt.Sprintf("InlineOutput=%v, ", config.InlineOutput))
 	buf.WriteString(fmt.Sprintf("InlineStdoutOnly=%v, ", config.InlineStdoutOnly))
+	buf.WriteString(fmt.Sprintf("StreamOutput=%v, ", config.StreamOutput))
+	buf.WriteString(fmt.Sprintf("OutputFormat=%v, ", config.OutputFormat))
 	buf.WriteString(fmt.Sprintf("OutDirectory=%s, ", config.OutDirectory))
 	buf.WriteString(fmt.Sprintf("ErrDirectory=%s, ", config.ErrDirectory))
 	buf.WriteString(fmt.Sprintf("Parallelism=%d, ", config.Parallelism))
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	l "github.com/cinsk/triton-pssh/log"
+	shellquote "github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// EnvVar is an environment variable for the remote commands.
+type EnvVar struct {
+	Name  string
+	Value string
+}
+
+var regexpEnvName = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// ParseEnv parses S in the form of KEY=VALUE.  If S has no '=', the value
+// is taken from the local environment.
+func ParseEnv(s string) (EnvVar, error) {
+	var v EnvVar
+
+	if i := strings.Index(s, "="); i < 0 {
+		v.Name = s
+		v.Value = os.Getenv(s)
+	} else {
+		v.Name = s[:i]
+		v.Value = s[i+1:]
+	}
+
+	if !regexpEnvName.MatchString(v.Name) {
+		return v, fmt.Errorf("invalid environment variable name: %s", v.Name)
+	}
+	return v, nil
+}
+
+// LoadEnvFile reads the environment variables from FILENAME.  Each line
+// has the form of KEY=VALUE, optionally prefixed by "export".  The value
+// may be quoted with single or double quotes.  Empty lines and the lines
+// starting with '#' are ignored.
+func LoadEnvFile(filename string) ([]EnvVar, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars []EnvVar
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		if !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("%s:%d: missing '='", filename, lineno)
+		}
+		v, err := ParseEnv(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineno, err)
+		}
+		if n := len(v.Value); n >= 2 && (v.Value[0] == '"' || v.Value[0] == '\'') && v.Value[n-1] == v.Value[0] {
+			v.Value = v.Value[1 : n-1]
+		}
+		vars = append(vars, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// exportPreamble returns the shell commands that export VARS.
+func exportPreamble(vars []EnvVar) string {
+	if len(vars) == 0 {
+		return ""
+	}
+	words := []string{"export"}
+	for _, v := range vars {
+		words = append(words, fmt.Sprintf("%s=%s", v.Name, shellquote.Join(v.Value)))
+	}
+	return strings.Join(words, " ") + "; "
+}
+
+// applyEnv sets VARS to SESSION by "env" requests.  Since many servers
+// accept only a few variables (e.g. AcceptEnv in sshd_config(5)), it
+// returns the shell preamble that exports the variables rejected by the
+// server.  The preamble should be prepended to the command.
+func applyEnv(session *ssh.Session, vars []EnvVar) string {
+	var rejected []EnvVar
+
+	for _, v := range vars {
+		if err := session.Setenv(v.Name, v.Value); err != nil {
+			l.Debug("applyEnv: %s rejected: %v", v.Name, err)
+			rejected = append(rejected, v)
+		}
+	}
+	return exportPreamble(rejected)
+}
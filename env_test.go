@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEnv_ParseEnv(env *testing.T) {
+	os.Setenv("TRITON_PSSH_TEST_ENV", "local value")
+
+	cases := []struct {
+		arg   string
+		name  string
+		value string
+	}{
+		{"FOO=bar", "FOO", "bar"},
+		{"FOO=", "FOO", ""},
+		{"FOO=a=b c", "FOO", "a=b c"},
+		{"TRITON_PSSH_TEST_ENV", "TRITON_PSSH_TEST_ENV", "local value"},
+	}
+	for _, c := range cases {
+		v, err := ParseEnv(c.arg)
+		if err != nil {
+			env.Errorf("unexpected error for %s: %v", c.arg, err)
+		}
+		if v.Name != c.name || v.Value != c.value {
+			env.Errorf("expected %s=|%s|, got %s=|%s|", c.name, c.value, v.Name, v.Value)
+		}
+	}
+
+	for _, arg := range []string{"=bar", "1FOO=bar", "FOO BAR=baz"} {
+		if _, err := ParseEnv(arg); err == nil {
+			env.Errorf("expected error for %s", arg)
+		}
+	}
+}
+
+func TestEnv_LoadEnvFile(env *testing.T) {
+	f, err := ioutil.TempFile("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# comment\n\nFOO=bar\nexport JAVA_OPTS=\"-Xmx1g -Xms1g\"\nQUOTED='it''s'\n")
+	f.Close()
+
+	vars, err := LoadEnvFile(f.Name())
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	expected := []EnvVar{{"FOO", "bar"}, {"JAVA_OPTS", "-Xmx1g -Xms1g"}, {"QUOTED", "it''s"}}
+	if len(vars) != len(expected) {
+		env.Fatalf("expected %v, got %v", expected, vars)
+	}
+	for i := range expected {
+		if vars[i] != expected[i] {
+			env.Errorf("expected %v, got %v", expected[i], vars[i])
+		}
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("FOO\n"), 0600)
+	if _, err := LoadEnvFile(f.Name()); err == nil {
+		env.Errorf("expected error for the line without '='")
+	}
+}
+
+func TestEnv_ExportPreamble(env *testing.T) {
+	if p := exportPreamble(nil); p != "" {
+		env.Errorf("expected empty preamble, got |%s|", p)
+	}
+
+	p := exportPreamble([]EnvVar{{"FOO", "bar"}, {"JAVA_OPTS", "-Xmx1g -Xms1g"}, {"EMPTY", ""}})
+	expected := "export FOO=bar JAVA_OPTS='-Xmx1g -Xms1g' EMPTY=''; "
+	if p != expected {
+		env.Errorf("expected |%s|, got |%s|", expected, p)
+	}
+}
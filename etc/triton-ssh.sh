@@ -9,8 +9,9 @@ Usage: $PROGRAM_NAME [TRITON-PSSH-OPTION...] -h HOST [::: SSH-OPTION...]
 
 FILTER-EXPRESSION is explained in http://github.com/cinsk/triton-pssh/README.md
 
-Unlike 'triton-pssh', this command requires nc(1) installed on the Bastion host
-when '-b BASTION' supplied.
+Without SSH-OPTION, the session is handled natively by 'triton-pssh --login'.
+With SSH-OPTION, this command uses ssh(1), which requires nc(1) installed on
+the Bastion host when '-b BASTION' supplied.
 
 Examples:
         # connect the Triton machine named 'my-instance' with public IP
@@ -37,6 +38,18 @@ EOF
     exit 1
 fi
 
+native=1
+for arg in "$@"; do
+    if [ "$arg" = ":::" ]; then
+        native=0
+        break
+    fi
+done
+
+if [ "$native" -eq 1 ]; then
+    exec triton-pssh --login "$@"
+fi
+
 script=$(triton-pssh -1 "$@")
 if [[ "$DEBUG" != "" && "$DEBUG" -gt 0 ]]; then
     echo "DEBUG: $script" 1>&2
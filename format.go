@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type OutputFormat int
+
+const (
+	FORMAT_TEXT OutputFormat = iota
+	FORMAT_JSON
+	FORMAT_NDJSON
+)
+
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch s {
+	case "text":
+		return FORMAT_TEXT, nil
+	case "json":
+		return FORMAT_JSON, nil
+	case "ndjson":
+		return FORMAT_NDJSON, nil
+	default:
+		return FORMAT_TEXT, fmt.Errorf("unknown output format: %s", s)
+	}
+}
+
+func (f OutputFormat) String() string {
+	switch f {
+	case FORMAT_TEXT:
+		return "text"
+	case FORMAT_JSON:
+		return "json"
+	case FORMAT_NDJSON:
+		return "ndjson"
+	default:
+		return fmt.Sprintf("OutputFormat(%d)", int(f))
+	}
+}
+
+// JsonResult is the machine-readable form of SshResult.  The "stdout" and
+// "stderr" keys are appended by writeJsonResult() from the spools.
+type JsonResult struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Server   string    `json:"server"`
+	Bastion  string    `json:"bastion,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"` // in seconds
+	Attempts int       `json:"attempts,omitempty"`
+
+	ExitStatus *int   `json:"exit_status"` // null if the command did not exit normally
+	Signal     string `json:"signal,omitempty"`
+	Class      string `json:"class"`
+	Error      string `json:"error,omitempty"`
+
+	StdoutFile string `json:"stdout_file,omitempty"`
+	StderrFile string `json:"stderr_file,omitempty"`
+
+	Files int   `json:"files,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// NewJsonResult returns the JsonResult of RESULT without the outputs, which
+// are streamed from the spools by JsonWriter.
+func NewJsonResult(result *SshResult) *JsonResult {
+	r := JsonResult{
+		ID:         result.InstanceID,
+		Name:       result.InstanceName,
+		User:       result.User,
+		Server:     result.Server,
+		Bastion:    result.Bastion,
+		Start:      result.Start,
+		End:        result.Time,
+		Attempts:   result.Attempts,
+		Class:      result.Class.String(),
+		StdoutFile: result.StdoutFile,
+		StderrFile: result.StderrFile,
+		Files:      result.Files,
+		Bytes:      result.Bytes,
+	}
+	if !result.Start.IsZero() {
+		r.Duration = result.Time.Sub(result.Start).Seconds()
+	}
+
+	if result.Status == nil {
+		status := 0
+		r.ExitStatus = &status
+	} else {
+		r.Error = result.Status.Error()
+		if ee, ok := result.Status.(*ssh.ExitError); ok {
+			status := ee.ExitStatus()
+			r.ExitStatus = &status
+			r.Signal = ee.Signal()
+		}
+	}
+	return &r
+}
+
+// JsonWriter writes the results in FORMAT_JSON or FORMAT_NDJSON.  Each
+// result is written as soon as it is given, one per line.  In FORMAT_JSON,
+// the results are the elements of an array, which is closed on Close().
+type JsonWriter struct {
+	out    io.Writer
+	format OutputFormat
+	count  int
+}
+
+func NewJsonWriter(out io.Writer, format OutputFormat) *JsonWriter {
+	return &JsonWriter{out: out, format: format}
+}
+
+func (w *JsonWriter) Write(result *SshResult) error {
+	if w.format == FORMAT_JSON {
+		sep := ",\n"
+		if w.count == 0 {
+			sep = "[\n"
+		}
+		if _, err := io.WriteString(w.out, sep); err != nil {
+			return err
+		}
+	}
+	w.count++
+
+	if err := writeJsonResult(w.out, result); err != nil {
+		return err
+	}
+	if w.format == FORMAT_JSON {
+		return nil
+	}
+	_, err := io.WriteString(w.out, "\n")
+	return err
+}
+
+func (w *JsonWriter) Close() error {
+	if w.format != FORMAT_JSON {
+		return nil
+	}
+	end := "\n]\n"
+	if w.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(w.out, end)
+	return err
+}
+
+// writeJsonResult writes RESULT as a JSON object to OUT.  The outputs are
+// copied from the spools, so that they are not read into memory at once.
+func writeJsonResult(out io.Writer, result *SshResult) error {
+	data, err := json.Marshal(NewJsonResult(result))
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(out)
+	bw.Write(data[:len(data)-1]) // without the closing brace
+
+	outputs := []struct {
+		name  string
+		spool *Spool
+	}{
+		{"stdout", result.Stdout},
+		{"stderr", result.Stderr},
+	}
+	for _, output := range outputs {
+		if output.spool == nil {
+			continue
+		}
+		fmt.Fprintf(bw, ",\"%s\":\"", output.name)
+		sw := jsonStringWriter{w: bw}
+		output.spool.WriteTo(&sw)
+		sw.Flush()
+		bw.WriteString("\"")
+	}
+	bw.WriteString("}")
+	return bw.Flush()
+}
+
+// jsonStringWriter writes the bytes given to it to W as the contents of a
+// JSON string, escaped as encoding/json does.  A UTF-8 sequence split
+// between two writes is held until the rest of it comes.
+type jsonStringWriter struct {
+	w    io.Writer
+	rest []byte
+}
+
+func (j *jsonStringWriter) Write(p []byte) (int, error) {
+	buf := append(j.rest, p...)
+	n := len(buf) - partialRune(buf)
+	j.rest = append([]byte{}, buf[n:]...)
+	if err := j.encode(buf[:n]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the held bytes, which are not a valid UTF-8 sequence.
+func (j *jsonStringWriter) Flush() error {
+	rest := j.rest
+	j.rest = nil
+	return j.encode(rest)
+}
+
+func (j *jsonStringWriter) encode(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(string(p))
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(data[1 : len(data)-1])
+	return err
+}
+
+// partialRune returns the length of the incomplete UTF-8 sequence at the
+// end of BUF, or 0 if none.
+func partialRune(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i > len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if utf8.FullRune(buf[i:]) {
+				return 0
+			}
+			return len(buf) - i
+		}
+	}
+	return 0
+}
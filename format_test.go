@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat_NewJsonResult(env *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	result := SshResult{
+		InstanceID:   "70db2402",
+		InstanceName: "kafka1",
+		User:         "root",
+		Server:       "10.0.0.1:22",
+		Bastion:      "root@165.225.136.229:22",
+		Start:        start,
+		Time:         start.Add(time.Duration(1500) * time.Millisecond),
+		Stdout:       NewSpool(0),
+		Stderr:       NewSpool(0),
+		Class:        RESULT_SUCCESS,
+	}
+	result.Stdout.Write([]byte("hello\n"))
+
+	r := NewJsonResult(&result)
+	if r.ExitStatus == nil || *r.ExitStatus != 0 {
+		env.Errorf("expected exit status 0, got %v", r.ExitStatus)
+	}
+	if r.Duration != 1.5 {
+		env.Errorf("expected duration 1.5, got %v", r.Duration)
+	}
+	if data, _ := json.Marshal(r); bytes.Contains(data, []byte(`"stdout"`)) {
+		env.Errorf("expected stdout to be streamed by JsonWriter, got %s", data)
+	}
+	if r.Class != "success" || r.Error != "" {
+		env.Errorf("expected success without error, got %s, %s", r.Class, r.Error)
+	}
+
+	result.Status = errors.New("connection refused")
+	result.Class = RESULT_CONNECTION_ERROR
+	result.Stdout = nil
+	result.Stderr = nil
+
+	r = NewJsonResult(&result)
+	if r.ExitStatus != nil {
+		env.Errorf("expected no exit status, got %v", *r.ExitStatus)
+	}
+	if r.Class != "connection error" || r.Error != "connection refused" {
+		env.Errorf("unexpected class(%s) or error(%s)", r.Class, r.Error)
+	}
+}
+
+func TestFormat_JsonWriter(env *testing.T) {
+	results := []SshResult{
+		{InstanceID: "id-1", InstanceName: "kafka1", Class: RESULT_SUCCESS},
+		{InstanceID: "id-2", InstanceName: "kafka2", Status: errors.New("EOF"), Class: RESULT_CONNECTION_ERROR},
+	}
+
+	out := bytes.Buffer{}
+	w := NewJsonWriter(&out, FORMAT_NDJSON)
+	for i := range results {
+		w.Write(&results[i])
+	}
+	w.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		env.Fatalf("expected 2 lines, got |%s|", out.String())
+	}
+	var r JsonResult
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil || r.Name != "kafka2" {
+		env.Errorf("cannot decode |%s|: %v", lines[1], err)
+	}
+
+	out.Reset()
+	w = NewJsonWriter(&out, FORMAT_JSON)
+	for i := range results {
+		w.Write(&results[i])
+	}
+	if !strings.Contains(out.String(), "kafka2") {
+		env.Errorf("FORMAT_JSON should write each result as it is given")
+	}
+	w.Close()
+
+	var rs []JsonResult
+	if err := json.Unmarshal(out.Bytes(), &rs); err != nil || len(rs) != 2 {
+		env.Errorf("cannot decode |%s|: %v", out.String(), err)
+	}
+
+	out.Reset()
+	NewJsonWriter(&out, FORMAT_JSON).Close()
+	if strings.TrimSpace(out.String()) != "[]" {
+		env.Errorf("expected an empty array, got |%s|", out.String())
+	}
+}
+
+func TestFormat_JsonWriterOutputs(env *testing.T) {
+	stdout := NewSpool(0)
+	defer stdout.Close()
+	stderr := NewSpool(0)
+	defer stderr.Close()
+
+	// large enough to be spooled, with a rune split between the writes
+	data := strings.Repeat("héllo <\"world\">\t\x01\n", SPOOL_THRESHOLD/8) + "\xff"
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		stdout.Write([]byte(data[i:end]))
+	}
+	stderr.Write([]byte("é"[:1]))
+
+	result := SshResult{InstanceID: "id-1", InstanceName: "kafka1", Stdout: stdout, Stderr: stderr}
+	out := bytes.Buffer{}
+	if err := NewJsonWriter(&out, FORMAT_NDJSON).Write(&result); err != nil {
+		env.Fatal(err)
+	}
+
+	var r struct {
+		JsonResult
+		Stdout *string `json:"stdout"`
+		Stderr *string `json:"stderr"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		env.Fatalf("cannot decode the result: %v", err)
+	}
+	if r.Stdout == nil {
+		env.Fatalf("missing stdout")
+	}
+	expected, _ := json.Marshal(data)
+	got, _ := json.Marshal(*r.Stdout)
+	if !bytes.Equal(got, expected) {
+		env.Errorf("stdout differs: %d bytes, expected %d bytes", len(got), len(expected))
+	}
+	if r.Stderr == nil || *r.Stderr != "\ufffd" {
+		env.Errorf("expected stderr |\\ufffd|, got %v", r.Stderr)
+	}
+	if r.Name != "kafka1" {
+		env.Errorf("expected name kafka1, got %s", r.Name)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 
 	l "github.com/cinsk/triton-pssh/log"
@@ -13,9 +12,17 @@ func GetSignersForTritonAPI(account string, keyId string, keyPath string) ([]aut
 	l.Debug("GetSigner: account=%v, keyId=%v, keyPath=%v", account, keyId, keyPath)
 	signers := []authentication.Signer{}
 
+	agentSigner, agentErr := authentication.NewSSHAgentSigner(
+		authentication.SSHAgentSignerInput{
+			KeyID:       keyId,
+			AccountName: account})
+
 	if keyPath != "" {
-		privateKey, err := ioutil.ReadFile(keyPath)
-		if err != nil {
+		// the passphrase is not asked if the agent has the key
+		privateKey, err := readRSAKeyMaterial(keyPath, agentErr != nil)
+		if isEncryptedKey(err) {
+			l.Debug("GetSigner: %s is encrypted, using the ssh agent", keyPath)
+		} else if err != nil {
 			l.Warn("cannot read key file matching keyid=[%s]: %s", keyId, err)
 		} else {
 			signer, err := authentication.NewPrivateKeySigner(authentication.PrivateKeySignerInput{
@@ -30,19 +37,15 @@ func GetSignersForTritonAPI(account string, keyId string, keyPath string) ([]aut
 		}
 	}
 
-	signer, err := authentication.NewSSHAgentSigner(
-		authentication.SSHAgentSignerInput{
-			KeyID:       keyId,
-			AccountName: account})
-	if err != nil {
-		l.Info("cannot get a signer from the ssh agent: %s", err)
+	if agentErr != nil {
+		l.Info("cannot get a signer from the ssh agent: %s", agentErr)
 	} else {
-		signers = append(signers, signer)
+		signers = append(signers, agentSigner)
 	}
 
 	if len(signers) == 0 {
 		default_private_key := filepath.Join(HomeDirectory, ".ssh", "id_rsa")
-		privateKey, err := ioutil.ReadFile(default_private_key)
+		privateKey, err := readRSAKeyMaterial(default_private_key, true)
 		if err != nil {
 			l.Warn("cannot read key file matching %s: %s", keyId, err)
 		} else {
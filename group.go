@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// OutputGroup is a distinct output, and the hosts that produced it.
+type OutputGroup struct {
+	Hosts  []string
+	Output *Spool
+}
+
+// OutputGrouper collects the outputs of the hosts, and groups the hosts by
+// the hash of their outputs, like "dshbak -c".
+type OutputGrouper struct {
+	groups map[[sha256.Size]byte]*OutputGroup
+}
+
+func NewOutputGrouper() *OutputGrouper {
+	return &OutputGrouper{groups: make(map[[sha256.Size]byte]*OutputGroup)}
+}
+
+// Add adds OUTPUT of the host NAME.  The output is hashed as it is read
+// from the spool, and only one spool is kept for each group; the grouper
+// owns OUTPUT, which is closed now if it is the same as the earlier one,
+// or by Close() otherwise.
+func (g *OutputGrouper) Add(name string, output *Spool) {
+	var sum [sha256.Size]byte
+	hash := sha256.New()
+	output.WriteTo(hash)
+	copy(sum[:], hash.Sum(nil))
+
+	group, ok := g.groups[sum]
+	if !ok {
+		group = &OutputGroup{Output: output}
+		g.groups[sum] = group
+	} else {
+		output.Close()
+	}
+	group.Hosts = append(group.Hosts, name)
+}
+
+// Close releases the spooled outputs of the groups.
+func (g *OutputGrouper) Close() {
+	for _, group := range g.groups {
+		group.Output.Close()
+	}
+}
+
+// Groups returns the groups in the descending order of the number of the
+// hosts, so the most common output comes first.
+func (g *OutputGrouper) Groups() []*OutputGroup {
+	groups := make([]*OutputGroup, 0, len(g.groups))
+	for _, group := range g.groups {
+		sort.Strings(group.Hosts)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Hosts) != len(groups[j].Hosts) {
+			return len(groups[i].Hosts) > len(groups[j].Hosts)
+		}
+		return groups[i].Hosts[0] < groups[j].Hosts[0]
+	})
+	return groups
+}
+
+// Print writes each distinct output once to OUT, with the header that lists
+// the hosts.  If the outputs differ, the headers of the groups other than
+// the most common one are highlighted.
+func (g *OutputGrouper) Print(out io.Writer, color aurora.Aurora) {
+	groups := g.Groups()
+	for i, group := range groups {
+		hosts := fmt.Sprintf("%s (%d)", CompressHosts(group.Hosts), len(group.Hosts))
+		rule := strings.Repeat("-", len(hosts))
+
+		if i > 0 {
+			fmt.Fprintf(out, "%s\n%s\n%s\n", color.Yellow(rule).Bold(), color.Yellow(hosts).Bold(), color.Yellow(rule).Bold())
+		} else {
+			fmt.Fprintf(out, "%s\n%s\n%s\n", color.Cyan(rule).Bold(), color.Cyan(hosts).Bold(), color.Cyan(rule).Bold())
+		}
+		w := lastByteWriter{w: out}
+		group.Output.WriteTo(&w)
+		if w.n > 0 && w.last != '\n' {
+			fmt.Fprintln(out)
+		}
+	}
+}
+
+// lastByteWriter remembers the last byte written to W.
+type lastByteWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.n += int64(n)
+		w.last = p[n-1]
+	}
+	return n, err
+}
+
+var regexpHostNumber = regexp.MustCompile(`^(.*?)([0-9]+)$`)
+
+// CompressHosts returns the compressed list of NAMES, where the names that
+// differ only in the trailing numbers are written in ranges, e.g.
+// "kafka[1-3,5],zk1".  Zero-padded numbers keep their width.
+func CompressHosts(names []string) string {
+	type key struct {
+		prefix string
+		width  int // the width of zero-padded numbers, or 0
+	}
+	numbers := make(map[key][]int)
+	var keys []key
+	var words []string
+
+	for _, name := range names {
+		match := regexpHostNumber.FindStringSubmatch(name)
+		if match == nil {
+			words = append(words, name)
+			continue
+		}
+		k := key{prefix: match[1]}
+		if len(match[2]) > 1 && match[2][0] == '0' {
+			k.width = len(match[2])
+		}
+		n, err := strconv.Atoi(match[2])
+		if err != nil {
+			words = append(words, name)
+			continue
+		}
+		if _, ok := numbers[k]; !ok {
+			keys = append(keys, k)
+		}
+		numbers[k] = append(numbers[k], n)
+	}
+
+	for _, k := range keys {
+		ns := numbers[k]
+		sort.Ints(ns)
+
+		format := "%d"
+		if k.width > 0 {
+			format = fmt.Sprintf("%%0%dd", k.width)
+		}
+
+		var ranges []string
+		for i := 0; i < len(ns); {
+			j := i
+			for j+1 < len(ns) && ns[j+1] <= ns[j]+1 {
+				j++
+			}
+			if ns[i] == ns[j] {
+				ranges = append(ranges, fmt.Sprintf(format, ns[i]))
+			} else {
+				ranges = append(ranges, fmt.Sprintf(format+"-"+format, ns[i], ns[j]))
+			}
+			i = j + 1
+		}
+
+		if len(ns) == 1 {
+			words = append(words, k.prefix+ranges[0])
+		} else {
+			words = append(words, fmt.Sprintf("%s[%s]", k.prefix, strings.Join(ranges, ",")))
+		}
+	}
+
+	sort.Strings(words)
+	return strings.Join(words, ",")
+}
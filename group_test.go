@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/logrusorgru/aurora"
+)
+
+func TestGroup_CompressHosts(env *testing.T) {
+	cases := []struct {
+		names    []string
+		expected string
+	}{
+		{[]string{"kafka3", "kafka1", "kafka2"}, "kafka[1-3]"},
+		{[]string{"kafka1", "kafka2", "kafka3", "kafka5", "kafka7", "kafka8", "kafka9", "kafka10", "kafka11", "kafka12"}, "kafka[1-3,5,7-12]"},
+		{[]string{"kafka1", "zk1", "zk2", "bastion"}, "bastion,kafka1,zk[1-2]"},
+		{[]string{"web01", "web02", "web03"}, "web[01-03]"},
+		{[]string{"db-1-a", "db-2-a"}, "db-1-a,db-2-a"},
+	}
+	for _, c := range cases {
+		if got := CompressHosts(c.names); got != c.expected {
+			env.Errorf("expected |%s|, got |%s|", c.expected, got)
+		}
+	}
+}
+
+func TestGroup_Print(env *testing.T) {
+	spool := func(s string) *Spool {
+		sp := NewSpool(0)
+		sp.Write([]byte(s))
+		return sp
+	}
+
+	g := NewOutputGrouper()
+	defer g.Close()
+	g.Add("kafka2", spool("kafka-2.1\n"))
+	g.Add("kafka1", spool("kafka-2.1\n"))
+	g.Add("kafka3", spool("kafka-1.0"))
+	g.Add("kafka4", spool("kafka-2.1\n"))
+
+	out := bytes.Buffer{}
+	g.Print(&out, aurora.NewAurora(false))
+
+	expected := `----------------
+kafka[1-2,4] (3)
+----------------
+kafka-2.1
+----------
+kafka3 (1)
+----------
+kafka-1.0
+`
+	if out.String() != expected {
+		env.Errorf("expected |%v|, got |%v|", expected, out.String())
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const KNOWN_HOSTS_FILENAME = "known_hosts"
+
+type HostKeyPolicy int
+
+const (
+	HOSTKEY_TOFU HostKeyPolicy = iota // trust on first use, reject changed keys
+	HOSTKEY_STRICT
+	HOSTKEY_OFF
+)
+
+func ParseHostKeyPolicy(s string) (HostKeyPolicy, error) {
+	switch strings.ToLower(s) {
+	case "tofu":
+		return HOSTKEY_TOFU, nil
+	case "strict":
+		return HOSTKEY_STRICT, nil
+	case "off", "no":
+		return HOSTKEY_OFF, nil
+	default:
+		return HOSTKEY_TOFU, fmt.Errorf("unknown host key policy %q; should be one of strict, tofu, or off", s)
+	}
+}
+
+func (p HostKeyPolicy) String() string {
+	switch p {
+	case HOSTKEY_STRICT:
+		return "strict"
+	case HOSTKEY_OFF:
+		return "off"
+	default:
+		return "tofu"
+	}
+}
+
+// HostKeyError is returned by the host key callback when the key presented
+// by the server cannot be verified.  Known is nil when there was no pinned
+// key for the host (only possible in strict mode).
+type HostKeyError struct {
+	HostID   string
+	HostName string
+
+	Known     ssh.PublicKey
+	Presented ssh.PublicKey
+}
+
+func (e *HostKeyError) Changed() bool {
+	return e.Known != nil
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Known == nil {
+		return fmt.Sprintf("host key for %s(%s) is unknown, %s %s is not trusted in strict mode",
+			e.HostName, e.HostID, e.Presented.Type(), ssh.FingerprintSHA256(e.Presented))
+	}
+	return fmt.Sprintf("host key for %s(%s) has changed: expected %s %s, got %s %s",
+		e.HostName, e.HostID,
+		e.Known.Type(), ssh.FingerprintSHA256(e.Known),
+		e.Presented.Type(), ssh.FingerprintSHA256(e.Presented))
+}
+
+// KnownHosts keeps pinned host keys of Triton instances.  Unlike
+// ssh(1), the keys are indexed by the Triton instance ID instead of the
+// address, since the IP addresses of the instances are reused frequently.
+//
+// Each line of the file has the form:
+//
+//	INSTANCE-ID KEY-TYPE BASE64-KEY [INSTANCE-NAME]
+type KnownHosts struct {
+	Filename string
+	Policy   HostKeyPolicy
+	Repin    bool // replace the pinned key when the server presents a different one
+
+	mutex sync.Mutex
+	keys  map[string]ssh.PublicKey
+	names map[string]string
+}
+
+func NewKnownHosts(filename string, policy HostKeyPolicy, repin bool) (*KnownHosts, error) {
+	hosts := KnownHosts{Filename: filename, Policy: policy, Repin: repin,
+		keys:  make(map[string]ssh.PublicKey),
+		names: make(map[string]string),
+	}
+
+	if policy == HOSTKEY_OFF {
+		return &hosts, nil
+	}
+
+	var err error
+	hosts.keys, hosts.names, err = readKnownHosts(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Debug("loaded %d host key(s) from %s", len(hosts.keys), filename)
+	return &hosts, nil
+}
+
+// readKnownHosts reads the pinned keys and the names of the hosts from
+// FILENAME.  A missing file has no keys.
+func readKnownHosts(filename string) (map[string]ssh.PublicKey, map[string]string, error) {
+	keys := make(map[string]ssh.PublicKey)
+	names := make(map[string]string)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, names, nil
+		}
+		return nil, nil, fmt.Errorf("cannot open known hosts file(%s): %s", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			l.Warn("%s:%d: malformed line, ignored", filename, lineno)
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			l.Warn("%s:%d: cannot parse host key: %s", filename, lineno, err)
+			continue
+		}
+		keys[fields[0]] = key
+		names[fields[0]] = comment
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("cannot read known hosts file(%s): %s", filename, err)
+	}
+	return keys, names, nil
+}
+
+// Lookup returns the pinned key of the host ID, or nil if there is none.
+func (h *KnownHosts) Lookup(id string) ssh.PublicKey {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.keys[id]
+}
+
+// Algorithms returns the host key algorithms that should be negotiated
+// with the host ID, so that the server presents the same type of key
+// that we pinned.  It returns nil if there is no pinned key, or if the
+// keys are repinned, since the server may no longer have that type of key.
+func (h *KnownHosts) Algorithms(id string) []string {
+	if h == nil || h.Policy == HOSTKEY_OFF || h.Repin {
+		return nil
+	}
+
+	key := h.Lookup(id)
+	if key == nil {
+		return nil
+	}
+
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{key.Type()}
+}
+
+// Verify checks KEY against the pinned key of the host ID.
+func (h *KnownHosts) Verify(id string, name string, key ssh.PublicKey) error {
+	if h == nil || h.Policy == HOSTKEY_OFF {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	known, ok := h.keys[id]
+	if ok && bytes.Equal(known.Marshal(), key.Marshal()) {
+		return nil
+	}
+
+	if ok && !h.Repin {
+		return &HostKeyError{HostID: id, HostName: name, Known: known, Presented: key}
+	}
+	if !ok && h.Policy == HOSTKEY_STRICT && !h.Repin {
+		return &HostKeyError{HostID: id, HostName: name, Presented: key}
+	}
+
+	if ok {
+		l.Warn("replacing the host key of %s(%s): %s -> %s", name, id, ssh.FingerprintSHA256(known), ssh.FingerprintSHA256(key))
+	} else {
+		l.Info("pinning the host key of %s(%s): %s", name, id, ssh.FingerprintSHA256(key))
+	}
+
+	h.keys[id] = key
+	h.names[id] = name
+
+	var err error
+	if ok {
+		err = h.replace(id)
+	} else {
+		err = h.append(id, name, key)
+	}
+	if err != nil {
+		l.Warn("cannot record the host key of %s(%s): %s", name, id, err)
+	}
+	return nil
+}
+
+// Callback returns ssh.HostKeyCallback that verifies the host key of the
+// Triton instance ID.
+func (h *KnownHosts) Callback(id string, name string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		l.Debug("verifying host key of %s(%s) at %s: %s", name, id, remote, ssh.FingerprintSHA256(key))
+		return h.Verify(id, name, key)
+	}
+}
+
+func knownHostsLine(id string, name string, key ssh.PublicKey) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if name != "" {
+		line = fmt.Sprintf("%s %s", line, name)
+	}
+	return fmt.Sprintf("%s %s\n", id, line)
+}
+
+// lock takes the lock file of the known hosts file, so that the runs at the
+// same time do not lose the keys pinned by each other.  The returned
+// function releases the lock.
+func (h *KnownHosts) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(h.Filename), 0755); err != nil {
+		return nil, err
+	}
+
+	lockname := h.Filename + ".lock"
+	f, err := os.OpenFile(lockname, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file(%s): %s", lockname, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %s", lockname, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// append adds the new key of the host ID at the end of the file.
+func (h *KnownHosts) append(id string, name string, key ssh.PublicKey) error {
+	unlock, err := h.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(h.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open known hosts file(%s): %s", h.Filename, err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(knownHostsLine(id, name, key)); err != nil {
+		return fmt.Errorf("cannot write to known hosts file(%s): %s", h.Filename, err)
+	}
+	return nil
+}
+
+// replace rewrites the file with the new key of the host ID.  The file is
+// read again, so that the keys pinned by the other runs since NewKnownHosts()
+// are kept.
+func (h *KnownHosts) replace(id string) error {
+	unlock, err := h.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	keys, names, err := readKnownHosts(h.Filename)
+	if err != nil {
+		return err
+	}
+	keys[id] = h.keys[id]
+	names[id] = h.names[id]
+
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := bytes.Buffer{}
+	for _, id := range ids {
+		buf.WriteString(knownHostsLine(id, names[id], keys[id]))
+	}
+
+	tmpname := h.Filename + ".tmp"
+	if err := ioutil.WriteFile(tmpname, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("cannot write known hosts file(%s): %s", tmpname, err)
+	}
+	if err := os.Rename(tmpname, h.Filename); err != nil {
+		os.Remove(tmpname)
+		return fmt.Errorf("cannot replace known hosts file(%s): %s", h.Filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(env *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		env.Fatalf("cannot generate a key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		env.Fatalf("cannot create a public key: %v", err)
+	}
+	return key
+}
+
+func TestKnownHosts_TrustOnFirstUse(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, KNOWN_HOSTS_FILENAME)
+	key1 := newTestHostKey(env)
+	key2 := newTestHostKey(env)
+
+	hosts, err := NewKnownHosts(filename, HOSTKEY_TOFU, false)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := hosts.Verify("id-1", "host-1", key1); err != nil {
+		env.Errorf("first use should be trusted, got %v", err)
+	}
+	if err := hosts.Verify("id-1", "host-1", key1); err != nil {
+		env.Errorf("pinned key should be trusted, got %v", err)
+	}
+
+	// reload from the file; the key should be persisted.
+	hosts, err = NewKnownHosts(filename, HOSTKEY_TOFU, false)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	if err := hosts.Verify("id-1", "host-1", key1); err != nil {
+		env.Errorf("persisted key should be trusted, got %v", err)
+	}
+
+	err = hosts.Verify("id-1", "host-1", key2)
+	hkerr, ok := err.(*HostKeyError)
+	if !ok {
+		env.Fatalf("expected *HostKeyError, got [%T]%v", err, err)
+	}
+	if !hkerr.Changed() {
+		env.Errorf("HostKeyError should report the key change")
+	}
+}
+
+func TestKnownHosts_Strict(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts, err := NewKnownHosts(filepath.Join(dir, KNOWN_HOSTS_FILENAME), HOSTKEY_STRICT, false)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	err = hosts.Verify("id-1", "host-1", newTestHostKey(env))
+	hkerr, ok := err.(*HostKeyError)
+	if !ok {
+		env.Fatalf("expected *HostKeyError, got [%T]%v", err, err)
+	}
+	if hkerr.Changed() {
+		env.Errorf("HostKeyError should report the unknown key, not the changed one")
+	}
+}
+
+func TestKnownHosts_Repin(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, KNOWN_HOSTS_FILENAME)
+	key1 := newTestHostKey(env)
+	key2 := newTestHostKey(env)
+
+	hosts, _ := NewKnownHosts(filename, HOSTKEY_TOFU, false)
+	hosts.Verify("id-1", "host-1", key1)
+	hosts.Verify("id-2", "host-2", key1)
+
+	hosts, _ = NewKnownHosts(filename, HOSTKEY_STRICT, true)
+	if err := hosts.Verify("id-1", "host-1", key2); err != nil {
+		env.Errorf("repin should accept the new key, got %v", err)
+	}
+
+	hosts, _ = NewKnownHosts(filename, HOSTKEY_STRICT, false)
+	if err := hosts.Verify("id-1", "host-1", key2); err != nil {
+		env.Errorf("repinned key should be trusted, got %v", err)
+	}
+	if err := hosts.Verify("id-2", "host-2", key1); err != nil {
+		env.Errorf("other pinned keys should be preserved, got %v", err)
+	}
+}
+
+func TestKnownHosts_ConcurrentRuns(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, KNOWN_HOSTS_FILENAME)
+	key1 := newTestHostKey(env)
+	key2 := newTestHostKey(env)
+
+	hosts, _ := NewKnownHosts(filename, HOSTKEY_TOFU, false)
+	hosts.Verify("id-1", "host-1", key1)
+
+	// two runs loaded the file at the same time
+	run1, _ := NewKnownHosts(filename, HOSTKEY_TOFU, true)
+	run2, _ := NewKnownHosts(filename, HOSTKEY_TOFU, false)
+
+	run2.Verify("id-2", "host-2", key1)
+	run1.Verify("id-3", "host-3", key1)
+	run1.Verify("id-1", "host-1", key2)
+
+	hosts, _ = NewKnownHosts(filename, HOSTKEY_STRICT, false)
+	if err := hosts.Verify("id-1", "host-1", key2); err != nil {
+		env.Errorf("repinned key should be trusted, got %v", err)
+	}
+	for _, id := range []string{"id-2", "id-3"} {
+		if err := hosts.Verify(id, "host", key1); err != nil {
+			env.Errorf("key pinned by the other run should be preserved, got %v", err)
+		}
+	}
+}
+
+func TestKnownHosts_RepinChangedKeyType(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the instance had a RSA host key, and now has only ed25519 key
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		env.Fatalf("cannot generate a key: %v", err)
+	}
+	oldKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		env.Fatalf("cannot create a public key: %v", err)
+	}
+
+	filename := filepath.Join(dir, KNOWN_HOSTS_FILENAME)
+	hosts, _ := NewKnownHosts(filename, HOSTKEY_TOFU, false)
+	hosts.Verify("id-1", "host-1", oldKey)
+
+	dial := func(hosts *KnownHosts) error {
+		config := testClientConfig()
+		config.HostKeyAlgorithms = hosts.Algorithms("id-1")
+		config.HostKeyCallback = hosts.Callback("id-1", "host-1")
+		client, err := ssh.Dial("tcp", server.Addr(), config)
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	if err := dial(hosts); err == nil {
+		env.Errorf("expected error for the changed key type")
+	}
+
+	hosts, _ = NewKnownHosts(filename, HOSTKEY_TOFU, true)
+	if err := dial(hosts); err != nil {
+		env.Fatalf("repin should accept the new key type, got %v", err)
+	}
+
+	hosts, _ = NewKnownHosts(filename, HOSTKEY_STRICT, false)
+	if key := hosts.Lookup("id-1"); key == nil || key.Type() != ssh.KeyAlgoED25519 {
+		env.Errorf("expected the repinned ed25519 key, got %v", key)
+	}
+	if err := dial(hosts); err != nil {
+		env.Errorf("repinned key should be trusted, got %v", err)
+	}
+}
+
+func TestKnownHosts_Off(env *testing.T) {
+	hosts, err := NewKnownHosts("/nonexistent/known_hosts", HOSTKEY_OFF, false)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	if err := hosts.Verify("id-1", "host-1", newTestHostKey(env)); err != nil {
+		env.Errorf("no verification expected, got %v", err)
+	}
+
+	var none *KnownHosts
+	if err := none.Verify("id-1", "host-1", newTestHostKey(env)); err != nil {
+		env.Errorf("nil KnownHosts should not verify, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	l "github.com/cinsk/triton-pssh/log"
+	shellquote "github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Login runs an interactive SSH session on the server of JOB, through the
+// bastion if needed.  If the standard input is a terminal, it is put into
+// raw mode and a PTY is allocated for the session, otherwise the standard
+// input/output are just connected to the session.
+//
+// If JOB has no command, the login shell of the remote user is started.
+func (s *SshSession) Login(job *SshJob) error {
+	client, closeClient, _, err := s.connectRetry(job, 0)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	fd := int(syscall.Stdin)
+	if job.Pty != nil && terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(fd, state)
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		l.Debug("Login: allocating Pty: %v", job.Pty)
+		if err := session.RequestPty(job.Pty.Term, job.Pty.Height, job.Pty.Width, modes); err != nil {
+			return err
+		}
+
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer func() {
+			signal.Stop(winch)
+			close(winch)
+		}()
+
+		go func() {
+			for range winch {
+				w, h := TerminalSize()
+				l.Debug("Login: window size changed to %dx%d", w, h)
+				session.WindowChange(h, w)
+			}
+		}()
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	preamble := applyEnv(session, s.config.Env)
+
+	if len(job.Command) == 0 {
+		if preamble != "" {
+			// the login shell cannot have the preamble
+			return session.Run(preamble + "exec \"${SHELL:-/bin/sh}\" -l")
+		}
+		if err := session.Shell(); err != nil {
+			return err
+		}
+		return session.Wait()
+	}
+
+	return session.Run(preamble + shellquote.Join(job.Command...))
+}
+
+// NewRequestPty returns RequestPty for the local terminal.
+func NewRequestPty() *RequestPty {
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	w, h := TerminalSize()
+
+	return &RequestPty{Term: term, Width: w, Height: h}
+}
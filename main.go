@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,23 +30,42 @@ import (
 
 var instanceChannel = make(chan compute.Instance, 1)
 
-func getBastion(client *compute.ComputeClient, context context.Context, name string) (string, string, error) {
+func getBastion(client *compute.ComputeClient, context context.Context, name string) (string, string, string, error) {
 	instances, err := client.Instances().List(context, &compute.ListInstancesInput{Name: name})
 
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	} else if len(instances) == 0 {
-		return "", "", nil
+		return "", "", "", nil
 	} else {
-		// ip, user, error
+		// ip, user, id, error
 
 		img, _ := ImgCache.Get(instances[0].Image)
 		user := DefaultUser(img)
 
-		return instances[0].PrimaryIP, user, nil
+		return instances[0].PrimaryIP, user, instances[0].ID, nil
 	}
 }
 
+// getBastionID returns the ID of the instance that has the IP address
+// ADDR, or an empty string if none.  The instances are read from the cache
+// if possible.
+func getBastionID(client *compute.ComputeClient, context context.Context, addr string) string {
+	id := ""
+	for instance := range ListInstances(client, context, Config.InstanceCacheExpiration) {
+		if id != "" {
+			continue
+		}
+		for _, ip := range instance.IPs {
+			if ip == addr {
+				id = instance.ID
+				break
+			}
+		}
+	}
+	return id
+}
+
 const (
 	OPTION_HELP = iota
 	OPTION_VERSION
@@ -51,8 +74,86 @@ const (
 	OPTION_DEFAULT_USER
 	OPTION_PASSWORD
 	OPTION_NOCACHE
+	OPTION_HOST_KEY_CHECK
+	OPTION_REPIN
+	OPTION_STREAM
+	OPTION_LOGIN
+	OPTION_BASTION_MAX_CHANNELS
+	OPTION_RETRIES
+	OPTION_RETRY_BACKOFF
+	OPTION_FORMAT
+	OPTION_ENV
+	OPTION_ENV_FILE
+	OPTION_LISTEN
+	OPTION_HTTP_CONNECT
+	OPTION_OUTPUT
+	OPTION_DEADLINE
+	OPTION_IDLE_TIMEOUT
+	OPTION_KEEPALIVE
+	OPTION_GROUP_OUTPUT
+	OPTION_MAX_OUTPUT
+	OPTION_SCRIPT
+	OPTION_INTERPRETER
+	OPTION_SUDO
+	OPTION_SUDO_USER
+	OPTION_SUDO_PASSWORD_FILE
+	OPTION_CERTIFICATE
+	OPTION_PASSWORD_FILE
 )
 
+type RunMode int
+
+const (
+	RUN_PSSH RunMode = iota
+	RUN_UPLOAD
+	RUN_DOWNLOAD
+	RUN_TUNNEL
+	RUN_PROXY
+	RUN_SOCKS
+	RUN_SSH_CONFIG
+)
+
+var RunModes = map[string]RunMode{
+	"cp":         RUN_UPLOAD,
+	"get":        RUN_DOWNLOAD,
+	"tunnel":     RUN_TUNNEL,
+	"proxy":      RUN_PROXY,
+	"socks":      RUN_SOCKS,
+	"ssh-config": RUN_SSH_CONFIG,
+}
+
+func (m RunMode) String() string {
+	for name, mode := range RunModes {
+		if mode == m {
+			return name
+		}
+	}
+	return "pssh"
+}
+
+// SplitRunMode returns the run mode selected by the first word after the
+// options in ARGS, and ARGS without the word.  The options are only skipped
+// here, and parsed by ParseOptions() later.
+func SplitRunMode(args []string) (RunMode, []string) {
+	context := GetoptContext{Options: Options, Args: args}
+	for {
+		opt, err := context.Getopt()
+		if err != nil || opt == nil {
+			break
+		}
+	}
+
+	rest := context.Arguments()
+	n := len(args) - len(rest)
+	// the words after "--" are not the run mode
+	if len(rest) > 0 && (n == 0 || args[n-1] != "--") {
+		if mode, ok := RunModes[rest[0]]; ok {
+			return mode, append(append([]string{}, args[:n]...), rest[1:]...)
+		}
+	}
+	return RUN_PSSH, args
+}
+
 var Options = []OptionSpec{
 	{OPTION_HELP, "help", NO_ARGUMENT},
 	{OPTION_VERSION, "version", NO_ARGUMENT},
@@ -61,27 +162,53 @@ var Options = []OptionSpec{
 	{OPTION_URL, "url", ARGUMENT_REQUIRED},
 	{'u', "user", ARGUMENT_REQUIRED},
 	{'P', "port", ARGUMENT_REQUIRED},
+	{OPTION_ENV, "env", ARGUMENT_REQUIRED},
+	{OPTION_ENV_FILE, "env-file", ARGUMENT_REQUIRED},
+	{OPTION_SCRIPT, "script", ARGUMENT_REQUIRED},
+	{OPTION_INTERPRETER, "interpreter", ARGUMENT_REQUIRED},
+	{OPTION_SUDO, "sudo", NO_ARGUMENT},
+	{OPTION_SUDO_USER, "sudo-user", ARGUMENT_REQUIRED},
+	{OPTION_SUDO_PASSWORD_FILE, "sudo-password-file", ARGUMENT_REQUIRED},
 
 	{'b', "bastion", ARGUMENT_REQUIRED},
 	{'B', "force-bastion", NO_ARGUMENT},
+	{OPTION_BASTION_MAX_CHANNELS, "bastion-max-channels", ARGUMENT_REQUIRED},
+
+	{OPTION_HOST_KEY_CHECK, "host-key-check", ARGUMENT_REQUIRED},
+	{OPTION_REPIN, "repin", NO_ARGUMENT},
 
 	{'T', "timeout", ARGUMENT_REQUIRED},
-	{'t', "deadline", ARGUMENT_REQUIRED},
+	{'t', "command-timeout", ARGUMENT_REQUIRED},
+	{OPTION_DEADLINE, "deadline", ARGUMENT_REQUIRED}, // obsolete alias of --command-timeout
+	{OPTION_IDLE_TIMEOUT, "idle-timeout", ARGUMENT_REQUIRED},
+	{OPTION_KEEPALIVE, "keepalive", ARGUMENT_REQUIRED},
+	{OPTION_RETRIES, "retries", ARGUMENT_REQUIRED},
+	{OPTION_RETRY_BACKOFF, "retry-backoff", ARGUMENT_REQUIRED},
 	{'p', "parallel", ARGUMENT_REQUIRED},
 	{'i', "inline", NO_ARGUMENT},
 	{'h', "host", ARGUMENT_REQUIRED},
 	{OPTION_INLINE_STDOUT, "inline-stdout", NO_ARGUMENT},
+	{OPTION_STREAM, "stream", NO_ARGUMENT},
+	{OPTION_GROUP_OUTPUT, "group-output", NO_ARGUMENT},
+	{OPTION_MAX_OUTPUT, "max-output", ARGUMENT_REQUIRED},
+	{OPTION_FORMAT, "format", ARGUMENT_REQUIRED},
+	{OPTION_LISTEN, "listen", ARGUMENT_REQUIRED},
+	{OPTION_HTTP_CONNECT, "http-connect", NO_ARGUMENT},
+	{OPTION_OUTPUT, "output", ARGUMENT_REQUIRED},
 	{'o', "outdir", ARGUMENT_REQUIRED},
 	{'e', "errdir", ARGUMENT_REQUIRED},
 	{OPTION_DEFAULT_USER, "default-user", ARGUMENT_REQUIRED},
 	{OPTION_PASSWORD, "password", NO_ARGUMENT},
+	{OPTION_PASSWORD_FILE, "password-file", ARGUMENT_REQUIRED},
 	{'A', "agent", NO_ARGUMENT},
+	{OPTION_CERTIFICATE, "certificate", ARGUMENT_REQUIRED},
 	{'I', "identity", ARGUMENT_REQUIRED},
 	{'d', "dryrun", NO_ARGUMENT},
 	{OPTION_NOCACHE, "no-cache", NO_ARGUMENT},
 	{'1', "ssh", NO_ARGUMENT},
 	{'2', "scp", NO_ARGUMENT},
 	{'3', "rsync", NO_ARGUMENT},
+	{OPTION_LOGIN, "login", NO_ARGUMENT},
 
 	{'n', "limit", ARGUMENT_REQUIRED},
 }
@@ -98,11 +225,33 @@ func init() {
 func HelpAndExit() {
 	msg := `Parallel SSH program for Joyent Triton instances
 Usage: triton-pssh [OPTION] FILTER-EXPRESSION... ::: COMMAND...
+       triton-pssh --script=FILE [OPTION] FILTER-EXPRESSION... [::: ARG...]
+       triton-pssh cp [OPTION] FILTER-EXPRESSION... ::: LOCAL... REMOTE
+       triton-pssh get [OPTION] FILTER-EXPRESSION... ::: REMOTE... LOCALDIR
+       triton-pssh tunnel [OPTION] FILTER-EXPRESSION... ::: [LPORT:]HOST:RPORT...
+       triton-pssh proxy [OPTION] HOST PORT
+       triton-pssh socks [OPTION] [PORT]
+       triton-pssh ssh-config [OPTION] [FILTER-EXPRESSION...]
 
 Option:
 
   -i, --inline             inline standard output and standard error for each server
       --inline-stdout      inline standard output only
+      --stream             print each line of output as it arrives, prefixed
+                             with the instance name
+      --group-output       print each distinct output once after all servers
+                             finished, with the list of the servers that
+                             produced it.  The outputs that differ from the
+                             most common one are highlighted
+      --max-output=BYTES   keep only the first and the last BYTES/2 of the
+                             output of each server for -i, --group-output
+                             and --format (default: no limit).  BYTES may
+                             have the suffix K, M or G
+      --format=FORMAT      the format of the results; text (default), json
+                             (an array of all results) or ndjson (one line
+                             per result).  In json and ndjson, the outputs
+                             are included in the results unless -o or -e is
+                             used, and the headers are not printed
 
   -o, --outdir=DIR         output directory for stdout files
   -e, --errdir=DIR         output directory for stderr files
@@ -121,17 +270,86 @@ Option:
   -I, --identity=KEYFILE   select a private key for public key authentication
                              for SSH session
   -A, --agent              use SSH agent for the authentication for SSH session
-      --password           use password authentication for SSH session
+      --certificate=FILE   use the OpenSSH user certificate FILE with the
+                             private key (or the agent key) of the same
+                             public key.  KEYFILE-cert.pub is used
+                             automatically for -I KEYFILE and the default keys
+      --password           use password (and keyboard-interactive)
+                             authentication for SSH session.  The password is
+                             read from $TRITON_PSSH_PASSWORD, or asked once on
+                             the terminal (or by $SSH_ASKPASS)
+      --password-file=FILE use password authentication with the passwords in
+                             FILE, which has "NAME PASSWORD",
+                             "tag:KEY=VALUE PASSWORD" or "* PASSWORD" per line
 
   -u, --user=USER          the username of the remote hosts
   -P, --port=PORT          the SSH port of the remote hosts
+      --env=KEY[=VALUE]    set the environment variable KEY of the remote
+                             commands.  Without VALUE, the local value of
+                             KEY is used.  This option can be used
+                             multiple times
+      --env-file=FILE      read the environment variables from FILE, which
+                             has KEY=VALUE per line
+      --script=FILE        upload the local script FILE to a temporary
+                             directory of each server, and run it with ARGs
+                             instead of COMMAND.  The script is removed
+                             afterwards.  The standard input is given to the
+                             script
+      --interpreter=PROG   run the script with PROG (e.g. "bash -x"), instead
+                             of running it directly
+      --sudo               run the command (or the script) with sudo(8)
+      --sudo-user=USER     run the command as USER with sudo(8), implies
+                             --sudo.  With --script, USER must be root
+      --sudo-password-file=FILE
+                           read the sudo password from the first line of FILE.
+                             Without it, the password is read from
+                             $TRITON_PSSH_SUDO_PASSWORD, or asked once on
+                             the terminal when a server asks it
 
   -b, --bastion=ENDPOINT   the endpoint([user@]NAME[:port]) of bastion server,
-                             NAME must be a Triton instance name
+                             NAME must be a Triton instance name.
+                             Repeat this option (or use a comma separated
+                             list) for the chain of bastion servers
   -B, --force-bastion      use bastion even for an instance with public IP.
+      --bastion-max-channels=N
+                           the max number of SSH sessions that share a
+                             bastion connection (default: 10)
+
+      --host-key-check=MODE
+                           host key verification mode; one of strict, tofu
+                             (trust on first use, default) or off.  Host keys
+                             are pinned in ~/.triton-pssh/known_hosts by the
+                             Triton instance ID
+      --repin              replace the pinned host keys of the selected
+                             instances, e.g. after reprovisioning
 
   -T, --timeout=TIMEOUT    the connection timeout of the SSH session
-  -t, --deadline=TIMEOUT   the timeout of the SSH session
+  -t, --command-timeout=TIMEOUT
+                           the max running time of the remote command or
+                             the transfer (default: no limit).  On timeout,
+                             SIGTERM is sent to the command, and the
+                             connection is closed if it does not exit in 5
+                             seconds.  --deadline is an obsolete alias
+      --idle-timeout=TIMEOUT
+                           the max time without any input or output of the
+                             remote command (default: no limit)
+      --keepalive=SECS     the interval of the SSH keepalive requests; the
+                             connection is closed if the server does not
+                             reply to 3 requests in a row (default: 15, 0
+                             disables it)
+      --retries=N          retry the connection (and the authentication) up
+                             to N times on failure.  The command itself is
+                             never retried
+      --retry-backoff=SECS the delay before the first retry (default: 1).
+                             It doubles for each retry
+
+      --login              open an interactive session to the first matched
+                             instance; COMMAND is optional
+      --listen=ADDR        the local address of the listeners in tunnel and
+                             socks mode (default: 127.0.0.1)
+      --http-connect       accept HTTP CONNECT requests as well in socks mode
+      --output=FILE        write the result of ssh-config mode to FILE,
+                             instead of the standard output
 
   -p, --parallel=MAXPROC   the max number of SSH connection at a time
   -n, --limit=LIMIT        Use only LIMIT instances at most
@@ -139,6 +357,53 @@ Option:
       --help               display this help and exit
       --version            output version information and exit
 
+Mode:
+
+  cp                       upload LOCAL files or directories to REMOTE of
+                             each instance over SFTP, preserving the modes
+                             and the modification times
+  get                      download REMOTE files, directories or glob
+                             patterns of each instance over SFTP into
+                             LOCALDIR/INSTANCE-NAME/
+  tunnel                   forward the local port LPORT to HOST:RPORT as seen
+                             from each instance, until interrupted.  The
+                             local ports are assigned automatically if LPORT
+                             is omitted, or for the instances other than the
+                             first one
+  proxy                    connect to HOST:PORT through the bastion servers,
+                             and relay it to the standard input and output.
+                             This is used as ProxyCommand of ssh(1) by
+                             -1, -2 and -3, so that the bastion servers do
+                             not need nc(1).  The bastion NAME can be an IP
+                             address
+  socks                    start a SOCKS5 proxy on the local PORT (default:
+                             1080), which connects through the bastion
+                             servers until interrupted.  The instance names
+                             are resolved to their primary IP addresses
+  ssh-config               print a ssh_config(5) fragment that has a Host
+                             block for each matched instance (all instances
+                             if FILTER-EXPRESSION is omitted).  The instances
+                             without public IP are reached by ProxyJump
+
+Placeholder:
+
+  {NAME}                   replaced in COMMAND with the field NAME of each
+                             instance, e.g. {name}, {id}, {primaryIp} or
+                             {image_name}.  Unknown fields are left untouched
+  {tag:KEY}                replaced with the tag KEY of each instance.  The
+                             instances without the tag fail
+  {{NAME}}, {{tag:KEY}}    replaced with {NAME} and {tag:KEY} literally
+
+Exit status:
+
+  0    all hosts succeeded
+  1    miscellaneous errors (e.g. a placeholder cannot be expanded)
+  3    at least one host timed out
+  4    at least one host was not reachable (connection or authentication error)
+  5    at least one remote command exited with non-zero status
+  6    no instance matched
+  130  interrupted by SIGINT or SIGTERM
+
 See https://github.com/cinsk/triton-pssh for FILTER-EXPRESSION and examples.
 
 `
@@ -167,6 +432,13 @@ func ParseOptions(args []string) []string {
 		if opt == nil {
 			break
 		}
+		switch opt.LongOption {
+		case "identity", "certificate", "password-file":
+			AddProxyOption(opt, ExpandPath(opt.Argument))
+		default:
+			AddProxyOption(opt, opt.Argument)
+		}
+
 		switch opt.LongOption {
 		case "help":
 			HelpAndExit()
@@ -184,12 +456,18 @@ func ParseOptions(args []string) []string {
 			if err := Config.Auth.AddPrivateKey(ExpandPath(opt.Argument)); err != nil {
 				l.ErrQuit(1, "cannot add publicKey authentication: %v", err)
 			}
+		case "certificate":
+			if err := Config.Auth.AddCertificate(ExpandPath(opt.Argument)); err != nil {
+				l.ErrQuit(1, "cannot add certificate authentication: %v", err)
+			}
 		case "agent":
 			if err := Config.Auth.AddAgent(); err != nil {
 				l.ErrQuit(1, "cannot add SSH agent authentication: %v", err)
 			}
 		case "password":
-			if err := Config.Auth.AddPassword(); err != nil {
+			Config.Auth.AddPassword()
+		case "password-file":
+			if err := Config.Auth.AddPasswordFile(ExpandPath(opt.Argument)); err != nil {
 				l.ErrQuit(1, "cannot add password authentication: %v", err)
 			}
 		case "user":
@@ -205,16 +483,34 @@ func ParseOptions(args []string) []string {
 			Config.ServerNames = append(Config.ServerNames, fmt.Sprintf("name == \"%s\"", opt.Argument))
 
 		case "bastion":
-			user, host, port, err := ParseUserHostPort(opt.Argument)
-			if err != nil {
-				l.ErrQuit(1, "cannot parse bastion endpoint: %v", err)
+			for _, endpoint := range strings.Split(opt.Argument, ",") {
+				if endpoint == "" {
+					continue
+				}
+				user, host, port, err := ParseUserHostPort(endpoint)
+				if err != nil {
+					l.ErrQuit(1, "cannot parse bastion endpoint: %v", err)
+				}
+				Config.Bastions = append(Config.Bastions, BastionHop{User: user, Name: host, Port: port})
 			}
-			Config.BastionName = host
-			Config.BastionPort = port
-			Config.BastionUser = user
 
 		case "force-bastion":
 			Config.ForceBastionOnPublicHost = true
+		case "bastion-max-channels":
+			i, err := strconv.Atoi(opt.Argument)
+			if err != nil || i <= 0 {
+				l.ErrQuit(1, "invalid argument: %s must be a positive number", opt.Argument)
+			}
+			Config.BastionMaxChannels = i
+
+		case "host-key-check":
+			policy, err := ParseHostKeyPolicy(opt.Argument)
+			if err != nil {
+				l.ErrQuit(1, "invalid argument: %v", err)
+			}
+			Config.HostKeyPolicy = policy
+		case "repin":
+			Config.RepinHostKeys = true
 
 		case "timeout":
 			f, err := strconv.ParseFloat(opt.Argument, 0)
@@ -224,12 +520,36 @@ func ParseOptions(args []string) []string {
 			Config.Timeout = time.Duration(f * float64(time.Second))
 			l.Debug("TIMEOUT: %v\n", Config.Timeout)
 
-		case "deadline":
+		case "command-timeout", "deadline":
+			f, err := strconv.ParseFloat(opt.Argument, 0)
+			if err != nil {
+				l.ErrQuit(1, "cannot convert %s to numberic value: %v", opt.Argument, err)
+			}
+			Config.CommandTimeout = time.Duration(f * float64(time.Second))
+		case "idle-timeout":
+			f, err := strconv.ParseFloat(opt.Argument, 0)
+			if err != nil {
+				l.ErrQuit(1, "cannot convert %s to numberic value: %v", opt.Argument, err)
+			}
+			Config.IdleTimeout = time.Duration(f * float64(time.Second))
+		case "keepalive":
 			f, err := strconv.ParseFloat(opt.Argument, 0)
 			if err != nil {
 				l.ErrQuit(1, "cannot convert %s to numberic value: %v", opt.Argument, err)
 			}
-			Config.Deadline = time.Duration(f * float64(time.Second))
+			Config.KeepaliveInterval = time.Duration(f * float64(time.Second))
+		case "retries":
+			i, err := strconv.Atoi(opt.Argument)
+			if err != nil || i < 0 {
+				l.ErrQuit(1, "invalid argument: %s must be a non-negative number", opt.Argument)
+			}
+			Config.Retries = i
+		case "retry-backoff":
+			f, err := strconv.ParseFloat(opt.Argument, 0)
+			if err != nil || f < 0 {
+				l.ErrQuit(1, "cannot convert %s to numeric value: %v", opt.Argument, err)
+			}
+			Config.RetryBackoff = time.Duration(f * float64(time.Second))
 		case "parallel":
 			i, err := strconv.Atoi(opt.Argument)
 			if err == nil {
@@ -245,6 +565,51 @@ func ParseOptions(args []string) []string {
 		case "inline-stdout":
 			Config.InlineOutput = true
 			Config.InlineStdoutOnly = true
+		case "stream":
+			Config.StreamOutput = true
+		case "group-output":
+			Config.GroupOutput = true
+		case "script":
+			Config.ScriptFile = ExpandPath(opt.Argument)
+		case "interpreter":
+			Config.Interpreter = opt.Argument
+		case "sudo":
+			Config.Sudo = true
+		case "sudo-user":
+			Config.Sudo = true
+			Config.SudoUser = opt.Argument
+		case "sudo-password-file":
+			Config.SudoPasswordFile = ExpandPath(opt.Argument)
+		case "max-output":
+			n, err := ParseSize(opt.Argument)
+			if err != nil {
+				l.ErrQuit(1, "invalid argument: %v", err)
+			}
+			Config.MaxOutput = n
+		case "env":
+			v, err := ParseEnv(opt.Argument)
+			if err != nil {
+				l.ErrQuit(1, "invalid argument: %v", err)
+			}
+			Config.Env = append(Config.Env, v)
+		case "env-file":
+			vars, err := LoadEnvFile(ExpandPath(opt.Argument))
+			if err != nil {
+				l.ErrQuit(1, "cannot read environment variables: %v", err)
+			}
+			Config.Env = append(Config.Env, vars...)
+		case "listen":
+			Config.ListenAddress = opt.Argument
+		case "http-connect":
+			Config.HttpConnect = true
+		case "output":
+			Config.OutputFile = ExpandPath(opt.Argument)
+		case "format":
+			format, err := ParseOutputFormat(opt.Argument)
+			if err != nil {
+				l.ErrQuit(1, "invalid argument: %v", err)
+			}
+			Config.OutputFormat = format
 		case "outdir":
 			dir := ExpandPath(opt.Argument)
 			if err := CheckOutputDirectory(dir, true); err != nil {
@@ -267,6 +632,8 @@ func ParseOptions(args []string) []string {
 			Config.PrintMode = MODE_SCP
 		case "rsync":
 			Config.PrintMode = MODE_RSYNC
+		case "login":
+			Config.Login = true
 		case "dryrun":
 			Config.DryRun = true
 		case "limit":
@@ -284,6 +651,38 @@ func ParseOptions(args []string) []string {
 	if Config.InlineOutput && (Config.OutDirectory != "" || Config.ErrDirectory != "") {
 		l.ErrQuit(1, "inline output(-i,--inline) cannot be used with (-o,--outdir,-e,--errdir)")
 	}
+	if Config.StreamOutput && (Config.InlineOutput || Config.OutDirectory != "" || Config.ErrDirectory != "") {
+		l.ErrQuit(1, "streaming output(--stream) cannot be used with (-i,--inline,-o,--outdir,-e,--errdir)")
+	}
+	if Config.Login && (Config.PrintMode != MODE_PSSH || Config.InlineOutput || Config.StreamOutput || Config.OutDirectory != "" || Config.ErrDirectory != "") {
+		l.ErrQuit(1, "interactive session(--login) cannot be used with (-1,-2,-3,-i,--stream,-o,-e)")
+	}
+	if Config.OutputFormat != FORMAT_TEXT && (Config.PrintMode != MODE_PSSH || Config.Login || Config.InlineOutput || Config.StreamOutput) {
+		l.ErrQuit(1, "%s format(--format) cannot be used with (-1,-2,-3,--login,-i,--inline-stdout,--stream)", Config.OutputFormat)
+	}
+	if Config.GroupOutput && (Config.PrintMode != MODE_PSSH || Config.Login || Config.StreamOutput || Config.OutDirectory != "" || Config.ErrDirectory != "" || Config.OutputFormat != FORMAT_TEXT || Config.RunMode != RUN_PSSH) {
+		l.ErrQuit(1, "grouped output(--group-output) cannot be used with (-1,-2,-3,--login,--stream,-o,-e,--format) or %s mode", Config.RunMode)
+	}
+	if Config.ScriptFile != "" && (Config.PrintMode != MODE_PSSH || Config.Login || Config.RunMode != RUN_PSSH) {
+		l.ErrQuit(1, "script(--script) cannot be used with (-1,-2,-3,--login) or %s mode", Config.RunMode)
+	}
+	if Config.ScriptFile != "" {
+		if err := CheckScriptSudoUser(Config.SudoUser); err != nil {
+			l.ErrQuit(1, "script(--script) cannot be used with --sudo-user: %v", err)
+		}
+	}
+	if Config.Interpreter != "" && Config.ScriptFile == "" {
+		l.ErrQuit(1, "interpreter(--interpreter) requires --script")
+	}
+	if Config.Sudo && (Config.PrintMode != MODE_PSSH || Config.Login || Config.RunMode != RUN_PSSH) {
+		l.ErrQuit(1, "sudo(--sudo) cannot be used with (-1,-2,-3,--login) or %s mode", Config.RunMode)
+	}
+	if err := Config.Auth.CheckCertificates(); err != nil {
+		l.ErrQuit(1, "cannot add certificate authentication: %v", err)
+	}
+	if Config.RunMode != RUN_PSSH && (Config.PrintMode != MODE_PSSH || Config.Login || Config.StreamOutput) {
+		l.ErrQuit(1, "%s mode cannot be used with (-1,-2,-3,--login,--stream)", Config.RunMode)
+	}
 
 	return context.Arguments()
 }
@@ -314,7 +713,9 @@ func TritonClientConfig(config *TsshConfig) *triton.ClientConfig {
 }
 
 func SplitArgs(args []string) (string, []string) {
-	if Config.PrintMode == MODE_PSSH && len(args) < 2 {
+	needCommand := Config.PrintMode == MODE_PSSH && !Config.Login && Config.RunMode != RUN_SSH_CONFIG && Config.ScriptFile == ""
+
+	if needCommand && len(args) < 2 {
 		l.Err("wrong number of argument(s)")
 		l.ErrQuit(1, "Try with '--help' for more")
 	}
@@ -347,15 +748,28 @@ func SplitArgs(args []string) (string, []string) {
 		}
 	}
 
+	if p == "" && Config.RunMode == RUN_SSH_CONFIG {
+		p = "true"
+	}
 	if p == "" {
 		l.ErrQuit(1, "no expression specified")
 	}
 
-	if Config.PrintMode == MODE_PSSH && len(commands) == 0 {
+	if needCommand && len(commands) == 0 {
 		l.Err("no command specified")
 		l.ErrQuit(1, "you might miss to use ':::' delimiter")
 	}
 
+	if Config.RunMode == RUN_UPLOAD && len(commands) < 2 {
+		l.ErrQuit(1, "cp requires one or more local files and the remote destination")
+	}
+	if Config.RunMode == RUN_DOWNLOAD && len(commands) < 2 {
+		l.ErrQuit(1, "get requires one or more remote files and the local directory")
+	}
+	if Config.RunMode == RUN_SSH_CONFIG && len(commands) > 0 {
+		l.ErrQuit(1, "ssh-config does not accept COMMAND")
+	}
+
 	return p, commands
 }
 
@@ -403,9 +817,15 @@ func main() {
 
 	l.Debug("Os.Args: %v\n", os.Args)
 
+	if exe, err := os.Executable(); err == nil {
+		ProxyProgram = exe
+	}
+
 	initOptions := OptionsFromInitFile()
 	l.Debug("Options From the option file: %v\n", initOptions)
-	args := ParseOptions(append(initOptions, os.Args[1:]...))
+	runMode, runArgs := SplitRunMode(os.Args[1:])
+	Config.RunMode = runMode
+	args := ParseOptions(append(initOptions, runArgs...))
 	l.Debug("Config: %v", Config)
 
 	if TritonProfileName == "" {
@@ -413,7 +833,28 @@ func main() {
 		l.ErrQuit(1, "Consider running 'eval \"$(triton env YOUR-PROFILE)\"'.")
 	}
 
-	expr, cmdline := SplitArgs(args)
+	var expr string
+	var cmdline []string
+	socksPort := strconv.Itoa(DEFAULT_SOCKS_PORT)
+	if Config.RunMode == RUN_PROXY {
+		if len(args) != 2 {
+			l.Err("wrong number of argument(s)")
+			l.ErrQuit(1, "proxy requires HOST and PORT")
+		}
+	} else if Config.RunMode == RUN_SOCKS {
+		if len(args) > 1 {
+			l.Err("wrong number of argument(s)")
+			l.ErrQuit(1, "socks accepts only the optional PORT")
+		}
+		if len(args) == 1 {
+			if port, err := strconv.Atoi(args[0]); err != nil || port < 0 || port > 65535 {
+				l.ErrQuit(1, "invalid port number: %s", args[0])
+			}
+			socksPort = args[0]
+		}
+	} else {
+		expr, cmdline = SplitArgs(args)
+	}
 	// if Config.Interactive && cmdline != "" {
 	// 	Err(1, nil, "interactive mode cannot accept COMMAND...")
 	// }
@@ -421,6 +862,37 @@ func main() {
 	l.Debug("Filter Expr: %s\n", expr)
 	l.Debug("Command: %s\n", cmdline)
 
+	if Config.RunMode == RUN_UPLOAD {
+		for _, src := range cmdline[:len(cmdline)-1] {
+			if _, err := os.Stat(src); err != nil {
+				l.ErrQuit(1, "cannot upload %s: %v", src, err)
+			}
+		}
+	}
+	if Config.RunMode == RUN_DOWNLOAD {
+		if err := CheckOutputDirectory(cmdline[len(cmdline)-1], true); err != nil {
+			l.ErrQuit(1, "invalid argument: %v", err)
+		}
+	}
+	var script *ScriptSpec
+	if Config.ScriptFile != "" {
+		var err error
+		script, err = NewScriptSpec(Config.ScriptFile, Config.Interpreter)
+		if err != nil {
+			l.ErrQuit(1, "cannot read the script: %v", err)
+		}
+	}
+	var forwards []ForwardSpec
+	if Config.RunMode == RUN_TUNNEL {
+		for _, arg := range cmdline {
+			f, err := ParseForwardSpec(arg)
+			if err != nil {
+				l.ErrQuit(1, "invalid argument: %v", err)
+			}
+			forwards = append(forwards, f)
+		}
+	}
+
 	if Config.TritonURL == "" {
 		l.ErrQuit(1, "missing Triton endpoint. SDC_URL undefined")
 	}
@@ -439,20 +911,52 @@ func main() {
 		NetCache = NewNetworkCache(nClient, Config.NetworkCacheExpiration)
 	}
 
-	if Config.BastionName != "" {
-		addr, user, err := getBastion(tritonClient, context.Background(), Config.BastionName)
+	for i := range Config.Bastions {
+		hop := &Config.Bastions[i]
+		if net.ParseIP(hop.Name) != nil {
+			hop.Address = hop.Name
+			if hop.User == "" {
+				hop.User = Config.DefaultUser
+			}
+			// the host key is pinned by the instance ID, e.g. for
+			// "proxy -b USER@IP:PORT" in the command-line print modes
+			hop.ID = getBastionID(tritonClient, context.Background(), hop.Name)
+			if hop.ID == "" {
+				l.Debug("no instance has the bastion address %s", hop.Name)
+			}
+			continue
+		}
+		addr, user, id, err := getBastion(tritonClient, context.Background(), hop.Name)
 		if err != nil {
 			l.ErrQuit(1, "cannot determine bastion server: %v", err)
 		}
-		Config.BastionAddress = addr
+		if addr == "" {
+			l.ErrQuit(1, "cannot find bastion server %s", hop.Name)
+		}
+		hop.Address = addr
+		hop.ID = id
 
-		if Config.BastionUser == "" {
-			Config.BastionUser = user
+		if hop.User == "" {
+			hop.User = user
 		}
 	}
 
 	l.Debug("Config: %v", Config)
 
+	HostKeys, err = NewKnownHosts(filepath.Join(TsshRoot, KNOWN_HOSTS_FILENAME), Config.HostKeyPolicy, Config.RepinHostKeys)
+	if err != nil {
+		l.ErrQuit(1, "cannot load known hosts: %v", err)
+	}
+
+	if Config.RunMode == RUN_PROXY {
+		SSH := NewSshSession(&Config, 0)
+		err := SSH.Proxy(SSH.BastionHops(&Config), net.JoinHostPort(args[0], args[1]), os.Stdin, os.Stdout)
+		if err != nil {
+			l.ErrQuit(EXIT_CONNECTION_ERROR, "cannot connect to %s:%s: %v", args[0], args[1], err)
+		}
+		os.Exit(EXIT_SUCCESS)
+	}
+
 	// hasPublicNet, userPublicNet := GetHasPublicNetwork(tritonConfig)
 	// hasPublicNet, userPublicNet := GetHasPublicNetwork(tritonConfig)
 	// UserFunctions["haspublic"] = userPublicNet
@@ -460,18 +964,75 @@ func main() {
 
 	color := aurora.NewAurora(terminal.IsTerminal(int(syscall.Stderr)))
 
+	if Config.Login || Config.RunMode == RUN_TUNNEL || Config.RunMode == RUN_SOCKS {
+		// the interactive session and the tunnels should not be limited
+		// by the timeouts
+		Config.CommandTimeout = 0
+		Config.IdleTimeout = 0
+	}
+
 	SSH := NewSshSession(&Config, Config.Parallelism)
 
 	instanceChan := ListInstances(tritonClient, context.Background(), Config.InstanceCacheExpiration)
 
-	inputFile, err := StdinFile()
-	if inputFile != nil {
-		defer os.Remove(inputFile.Name())
-		defer inputFile.Close()
+	var inputFile *os.File
+	if !Config.Login && Config.RunMode == RUN_PSSH {
+		inputFile, err = StdinFile()
+	}
+	removeInput := func() {
+		if inputFile != nil {
+			inputFile.Close()
+			os.Remove(inputFile.Name())
+		}
+	}
+
+	if !Config.Login {
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-sigs
+			l.Warn("%v received; interrupting the running commands (press again to quit immediately)", sig)
+			if sig == syscall.SIGTERM {
+				SSH.Cancel(ssh.SIGTERM)
+			} else {
+				SSH.Cancel(ssh.SIGINT)
+			}
+
+			<-sigs
+			removeInput()
+			os.Exit(EXIT_INTERRUPTED)
+		}()
+	}
+
+	if Config.RunMode == RUN_SOCKS {
+		names := make(map[string]string)
+		for instance := range instanceChan {
+			if instance.PrimaryIP != "" {
+				names[instance.Name] = instance.PrimaryIP
+			}
+		}
+		socks, err := SSH.OpenSocks(SSH.BastionHops(&Config), net.JoinHostPort(Config.ListenAddress, socksPort), names, Config.HttpConnect)
+		if err != nil {
+			l.ErrQuit(1, "cannot start SOCKS proxy: %v", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "SOCKS proxy listening on %s; press Ctrl-C to close\n", socks.Listener.Addr())
+		<-SSH.Done()
+		socks.Close()
+		SSH.Close()
+		os.Exit(EXIT_SUCCESS)
 	}
 
 	jobWg := sync.WaitGroup{}
 	resultChannel := make(chan SshResult)
+	var summary ResultSummary
+	var tunnels []*Tunnel
+	var hosts []SshConfigHost
+
+	var jsonOut *JsonWriter
+	if Config.OutputFormat != FORMAT_TEXT {
+		jsonOut = NewJsonWriter(os.Stdout, Config.OutputFormat)
+	}
 	var matched uint64 = 0
 	for instance := range instanceChan {
 		if IsDockerContainer(instance) {
@@ -482,9 +1043,9 @@ func main() {
 			img = &compute.Image{ID: instance.Image}
 		}
 
-		result, error := Evaluate(instance, img, expr)
-		if error != nil {
-			l.ErrQuit(1, "evaluation failed: %v", error)
+		result, err := Evaluate(instance, img, expr)
+		if err != nil {
+			l.ErrQuit(1, "evaluation failed: %v", err)
 		}
 		if r := bool(result); !r {
 			continue
@@ -498,12 +1059,57 @@ func main() {
 			break
 		}
 
-		job, err := SSH.BuildJob(instance, &Config, cmdline, inputFile)
+		skip := func(err error, class ResultClass) {
+			result := SshResult{InstanceID: instance.ID, InstanceName: instance.Name, Status: err, Class: class, Time: time.Now()}
+			summary.Add(&result)
+			if jsonOut != nil {
+				jsonOut.Write(&result)
+			}
+		}
+
+		command := cmdline
+		if Config.RunMode == RUN_PSSH && Config.PrintMode == MODE_PSSH {
+			command, err = ExpandFields(cmdline, buildContext(instance, img))
+			if err != nil {
+				l.Warn("warning: cannot expand the command: %s", err)
+				skip(err, RESULT_LOCAL_ERROR)
+				continue
+			}
+		}
+
+		if Config.RunMode == RUN_SSH_CONFIG {
+			host, err := NewSshConfigHost(instance, img, &Config)
+			if err != nil {
+				l.Warn("warning: %s", err)
+				continue
+			}
+			hosts = append(hosts, host)
+			continue
+		}
+
+		job, err := SSH.BuildJob(instance, &Config, command, inputFile)
 		if err != nil {
 			l.Warn("warning: cannot create SSH job: %s", err)
+			skip(err, RESULT_CONNECTION_ERROR)
 			continue
 		}
 		job.DryRun = Config.DryRun
+		job.Script = script
+
+		switch Config.RunMode {
+		case RUN_UPLOAD:
+			job.Transfer = &TransferSpec{Direction: TRANSFER_UPLOAD,
+				Sources:     cmdline[:len(cmdline)-1],
+				Destination: cmdline[len(cmdline)-1]}
+		case RUN_DOWNLOAD:
+			name := instance.Name
+			if name == "" {
+				name = instance.ID
+			}
+			job.Transfer = &TransferSpec{Direction: TRANSFER_DOWNLOAD,
+				Sources:     cmdline[:len(cmdline)-1],
+				Destination: filepath.Join(cmdline[len(cmdline)-1], name)}
+		}
 
 		if Config.PrintMode != MODE_PSSH {
 			err := SSH.PrintConf(job, Config.PrintMode)
@@ -517,8 +1123,45 @@ func main() {
 			os.Exit(0)
 		}
 
+		if Config.Login {
+			job.Pty = NewRequestPty()
+			err := SSH.Login(job)
+			if ee, ok := err.(*ssh.ExitError); ok {
+				os.Exit(ee.ExitStatus())
+			} else if err != nil {
+				l.ErrQuit(1, "cannot login to %s: %v", instance.Name, err)
+			}
+			os.Exit(0)
+		}
+
+		if Config.RunMode == RUN_TUNNEL {
+			fs := append([]ForwardSpec{}, forwards...)
+			if len(tunnels) > 0 {
+				// the local ports are used by the first instance
+				for i := range fs {
+					fs[i].LocalPort = 0
+				}
+			}
+			t, err := SSH.OpenTunnel(job, Config.ListenAddress, fs)
+			if err != nil {
+				l.Warn("warning: cannot open the tunnel to %s: %s", instance.Name, err)
+				continue
+			}
+			tunnels = append(tunnels, t)
+			for i, ln := range t.Listeners {
+				fmt.Printf("%s\t%s -> %s\n", instance.Name, ln.Addr(), fs[i].Remote())
+			}
+			continue
+		}
+
+		if !SSH.Run(job) {
+			// cancelled; do not start any more job
+			if job.Input != nil {
+				job.Input.Close()
+			}
+			break
+		}
 		jobWg.Add(1)
-		SSH.Run(job)
 
 		go func(input chan SshResult) {
 			defer jobWg.Done()
@@ -527,41 +1170,128 @@ func main() {
 		}(job.Result)
 	}
 
+	if Config.RunMode == RUN_SSH_CONFIG {
+		if matched == 0 {
+			l.Err("no instance matched to your request.")
+			l.ErrQuit(EXIT_NO_MATCH, "Consider using `--no-cache' option to update the cache")
+		}
+
+		var buf bytes.Buffer
+		WriteSshConfig(&buf, hosts)
+		if Config.OutputFile == "" {
+			os.Stdout.Write(buf.Bytes())
+		} else if updated, err := UpdateFile(Config.OutputFile, buf.Bytes()); err != nil {
+			l.ErrQuit(1, "%v", err)
+		} else if updated {
+			fmt.Fprintf(os.Stderr, "%s: %d host(s) written\n", Config.OutputFile, len(hosts))
+		}
+		SSH.Close()
+		os.Exit(EXIT_SUCCESS)
+	}
+
+	if Config.RunMode == RUN_TUNNEL {
+		if matched == 0 {
+			l.Err("no instance matched to your request.")
+			l.ErrQuit(EXIT_NO_MATCH, "Consider using `--no-cache' option to update the cache")
+		}
+		if len(tunnels) == 0 {
+			l.ErrQuit(EXIT_CONNECTION_ERROR, "no tunnel opened")
+		}
+
+		fmt.Fprintf(os.Stderr, "%d tunnel(s) opened; press Ctrl-C to close\n", len(tunnels))
+		<-SSH.Done()
+		for _, t := range tunnels {
+			t.Close()
+		}
+		SSH.Close()
+		os.Exit(EXIT_SUCCESS)
+	}
+
 	go func() {
 		defer close(resultChannel)
 		jobWg.Wait()
 	}()
 
 	count := 0
+	var transferred TransferSummary
+	var grouper *OutputGrouper
+	if Config.GroupOutput {
+		grouper = NewOutputGrouper()
+	}
 	for result := range resultChannel {
 		count++
+		transferred.Add(&result)
+		summary.Add(&result)
+
+		if jsonOut != nil {
+			if err := jsonOut.Write(&result); err != nil {
+				l.Err("cannot write the result of %s: %v", result.InstanceName, err)
+			}
+			result.Close()
+			continue
+		}
 
 		header := BuildResultHeader(count, &result, color)
 		fmt.Fprintf(os.Stderr, "%s\n", header)
 		l.Debug("Status: [%T] %v", result.Status, result.Status)
 
-		if Config.InlineOutput && result.Stdout != nil {
-			io.Copy(os.Stdout, result.Stdout)
+		if grouper != nil && result.Stdout != nil {
+			name := result.InstanceName
+			if name == "" {
+				name = result.InstanceID
+			}
+			grouper.Add(name, result.Stdout)
+			result.Stdout = nil
+		} else if Config.InlineOutput && result.Stdout != nil {
+			result.Stdout.WriteTo(os.Stdout)
 			os.Stdout.Sync()
 		}
+		result.Close()
 	}
 
 	SSH.Close()
 
+	if jsonOut != nil {
+		if err := jsonOut.Close(); err != nil {
+			l.Err("cannot write the results: %v", err)
+		}
+	} else if Config.RunMode == RUN_UPLOAD || Config.RunMode == RUN_DOWNLOAD {
+		fmt.Fprintf(os.Stderr, "%s\n", transferred.String())
+	}
+	if grouper != nil {
+		grouper.Print(os.Stdout, aurora.NewAurora(terminal.IsTerminal(int(syscall.Stdout))))
+		grouper.Close()
+	}
+
+	removeInput()
+
 	if matched == 0 {
 		l.Err("no instance matched to your request.")
-		l.ErrQuit(1, "Consider using `--no-cache' option to update the cache")
+		l.ErrQuit(EXIT_NO_MATCH, "Consider using `--no-cache' option to update the cache")
+	}
+
+	if jsonOut == nil {
+		summary.Print(os.Stderr)
+	}
+	if SSH.Cancelled() {
+		os.Exit(EXIT_INTERRUPTED)
 	}
+	os.Exit(summary.ExitCode())
 }
 
 func BuildResultHeader(index int, result *SshResult, color aurora.Aurora) string {
 	var header string
+	var hkerr *HostKeyError
+
 	if result.Status == nil {
 		header = fmt.Sprintf("%s %s %s %s %s@%s",
 			color.Sprintf(color.Cyan("[%d]").Bold(), index),
 			result.Time.Format("15:04:05"),
 			color.Green("[SUCCESS]").Bold(),
 			result.InstanceID, result.User, result.InstanceName)
+		if result.Files > 0 {
+			header += fmt.Sprintf(" %d file(s), %d bytes", result.Files, result.Bytes)
+		}
 	} else if ee, ok := result.Status.(*ssh.ExitError); ok {
 		var errmsg string
 		if ee.Signal() == "" {
@@ -575,6 +1305,21 @@ func BuildResultHeader(index int, result *SshResult, color aurora.Aurora) string
 			color.Red("[FAILURE]").Bold(),
 			result.InstanceID, result.User, result.InstanceName,
 			color.Red(errmsg).Bold())
+	} else if errors.As(result.Status, &hkerr) {
+		var errmsg string
+		if hkerr.Changed() {
+			errmsg = fmt.Sprintf("HOST KEY CHANGED for %s: expected %s, got %s; use --repin if the instance was reprovisioned",
+				hkerr.HostName, ssh.FingerprintSHA256(hkerr.Known), ssh.FingerprintSHA256(hkerr.Presented))
+		} else {
+			errmsg = fmt.Sprintf("HOST KEY UNKNOWN for %s: %s %s; use --repin to trust it",
+				hkerr.HostName, hkerr.Presented.Type(), ssh.FingerprintSHA256(hkerr.Presented))
+		}
+		header = fmt.Sprintf("%s %s %s %s %s@%s %s",
+			color.Sprintf(color.Cyan("[%d]").Bold(), index),
+			result.Time.Format("15:04:05"),
+			color.Red("[FAILURE]").Bold(),
+			result.InstanceID, result.User, result.InstanceName,
+			color.Red(errmsg).Bold())
 	} else {
 		header = fmt.Sprintf("%s %s %s %s %s@%s [%T] %s",
 			color.Sprintf(color.Cyan("[%d]").Bold(), index),
@@ -584,5 +1329,8 @@ func BuildResultHeader(index int, result *SshResult, color aurora.Aurora) string
 			result.Status,
 			color.Sprintf(color.Red("%s").Bold(), result.Status))
 	}
+	if result.Attempts > 1 {
+		header += fmt.Sprintf(" (%d attempts)", result.Attempts)
+	}
 	return header
 }
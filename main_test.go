@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMain_SplitRunMode(env *testing.T) {
+	cases := []struct {
+		args     []string
+		mode     RunMode
+		expected []string
+	}{
+		{[]string{"cp", "-A", "true", ":::", "a", "b"}, RUN_UPLOAD, []string{"-A", "true", ":::", "a", "b"}},
+		{[]string{"-A", "-b", "bastion", "cp", "true", ":::", "a", "b"}, RUN_UPLOAD, []string{"-A", "-b", "bastion", "true", ":::", "a", "b"}},
+		{[]string{"--user=root", "get", "true", ":::", "a", "."}, RUN_DOWNLOAD, []string{"--user=root", "true", ":::", "a", "."}},
+		{[]string{"-b", "cp", "true", ":::", "uptime"}, RUN_PSSH, []string{"-b", "cp", "true", ":::", "uptime"}},
+		{[]string{"-A", "--", "cp", ":::", "uptime"}, RUN_PSSH, []string{"-A", "--", "cp", ":::", "uptime"}},
+		{[]string{"-A", "true", ":::", "cp", "a", "b"}, RUN_PSSH, []string{"-A", "true", ":::", "cp", "a", "b"}},
+	}
+	for _, c := range cases {
+		mode, args := SplitRunMode(c.args)
+		if mode != c.mode || !reflect.DeepEqual(args, c.expected) {
+			env.Errorf("%v: expected %v %v, got %v %v", c.args, c.mode, c.expected, mode, args)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// decryptedKey is a private key that is decrypted once in a run.
+type decryptedKey struct {
+	once   sync.Once
+	key    interface{}
+	err    error
+	failed bool // guarded by decryptedKeys
+}
+
+// DecryptError is the error of decrypting the private key Filename.  The
+// key is skipped in the later connections.
+type DecryptError struct {
+	Filename string
+	Err      error
+}
+
+func (e *DecryptError) Error() string {
+	return e.Err.Error()
+}
+
+// askPassphrase asks the passphrase of a key; replaced in the tests.
+var askPassphrase = AskSecret
+
+var decryptedKeys = struct {
+	sync.Mutex
+	keys map[string]*decryptedKey
+}{keys: make(map[string]*decryptedKey)}
+
+// DecryptPrivateKey decrypts the encrypted private key PEMBYTES of
+// FILENAME.  The passphrase is asked only once for each file, and the
+// result is cached for the run, so both SSH sessions and Triton API can
+// use the same key.
+func DecryptPrivateKey(filename string, pemBytes []byte) (interface{}, error) {
+	decryptedKeys.Lock()
+	k, ok := decryptedKeys.keys[filename]
+	if !ok {
+		k = &decryptedKey{}
+		decryptedKeys.keys[filename] = k
+	}
+	decryptedKeys.Unlock()
+
+	k.once.Do(func() {
+		passphrase, err := askPassphrase(fmt.Sprintf("Enter passphrase for key '%s': ", filename))
+		if err != nil {
+			k.err = fmt.Errorf("cannot ask the passphrase of %s: %s", filename, err)
+		} else if k.key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase)); err != nil {
+			k.err = fmt.Errorf("cannot decrypt key file %s: %s", filename, err)
+		}
+		if k.err != nil {
+			l.Warn("warning: %s", k.err)
+			k.err = &DecryptError{Filename: filename, Err: k.err}
+		}
+		decryptedKeys.Lock()
+		k.failed = k.err != nil
+		decryptedKeys.Unlock()
+	})
+	return k.key, k.err
+}
+
+// isEncryptedKey returns true if ERR is from parsing an encrypted key.
+func isEncryptedKey(err error) bool {
+	_, ok := err.(*ssh.PassphraseMissingError)
+	return ok
+}
+
+// encryptedSigner is the signer of an encrypted private key.  The key is
+// decrypted when it is used first, i.e. when a server accepts the public
+// key, so that the passphrase is not asked for the unused keys.
+type encryptedSigner struct {
+	filename string
+	pemBytes []byte
+	pub      ssh.PublicKey
+}
+
+// newEncryptedSigner returns the signer of the encrypted key FILENAME.  The
+// public key is taken from ERR, or from FILENAME.pub.
+func newEncryptedSigner(filename string, pemBytes []byte, err *ssh.PassphraseMissingError) (*encryptedSigner, error) {
+	pub := err.PublicKey
+	if pub == nil {
+		buffer, err := ioutil.ReadFile(filename + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the public key of encrypted key file %s: %s", filename, err)
+		}
+		if pub, _, _, _, err = ssh.ParseAuthorizedKey(buffer); err != nil {
+			return nil, fmt.Errorf("cannot parse public key file from %s.pub: %s", filename, err)
+		}
+	}
+	return &encryptedSigner{filename: filename, pemBytes: pemBytes, pub: pub}, nil
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) signer() (ssh.Signer, error) {
+	key, err := DecryptPrivateKey(s.filename, s.pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// Failed returns true if the key could not be decrypted.
+func (s *encryptedSigner) Failed() bool {
+	decryptedKeys.Lock()
+	defer decryptedKeys.Unlock()
+	k, ok := decryptedKeys.keys[s.filename]
+	return ok && k.failed
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.signer()
+	if err != nil {
+		return nil, err
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	if algorithm != "" && algorithm != signer.PublicKey().Type() {
+		return nil, fmt.Errorf("unsupported signature algorithm %s for %s", algorithm, s.filename)
+	}
+	return signer.Sign(rand, data)
+}
+
+// readRSAKeyMaterial returns the RSA private key FILENAME in PKCS#1 PEM,
+// which triton-go requires.  If the key is encrypted, it is decrypted only
+// if ASK is true, otherwise the error of ssh.PassphraseMissingError is
+// returned.
+func readRSAKeyMaterial(filename string, ask bool) ([]byte, error) {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ssh.ParseRawPrivateKey(buffer)
+	if isEncryptedKey(err) && ask {
+		key, err = DecryptPrivateKey(filename, buffer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not a RSA key: %s", filename)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeEncryptedTestKey writes the RSA key encrypted with PASSPHRASE to
+// FILENAME in the legacy PEM format, and its public key to FILENAME.pub.
+func writeEncryptedTestKey(env *testing.T, filename string, passphrase string) ssh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		env.Fatalf("cannot generate a key: %v", err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		env.Fatalf("cannot encrypt the key: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+		env.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		env.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename+".pub", ssh.MarshalAuthorizedKey(pub), 0644); err != nil {
+		env.Fatal(err)
+	}
+	return pub
+}
+
+func TestPassphrase_EncryptedKey(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "id_rsa")
+	pub := writeEncryptedTestKey(env, keyfile, "secret")
+
+	var asked int32
+	askPassphrase = func(prompt string) (string, error) {
+		atomic.AddInt32(&asked, 1)
+		return "secret", nil
+	}
+	defer func() { askPassphrase = AskSecret }()
+
+	auth := AuthMethods{}
+	if err := auth.AddPrivateKey(keyfile); err != nil {
+		env.Fatalf("AddPrivateKey failed: %v", err)
+	}
+	if asked != 0 {
+		env.Errorf("the passphrase should not be asked before the key is used")
+	}
+
+	server := newTestSshServer(env)
+	defer server.Close()
+	server.Configure(func(c *ssh.ServerConfig) {
+		c.NoClientAuth = false
+		c.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		}
+	})
+
+	config := testClientConfig()
+	config.Auth = auth.Methods()
+	for i := 0; i < 2; i++ {
+		client, err := ssh.Dial("tcp", server.Addr(), config)
+		if err != nil {
+			env.Fatalf("cannot authenticate with the encrypted key: %v", err)
+		}
+		client.Close()
+	}
+
+	// the same key for Triton API
+	material, err := readRSAKeyMaterial(keyfile, true)
+	if err != nil {
+		env.Fatalf("readRSAKeyMaterial failed: %v", err)
+	}
+	if block, _ := pem.Decode(material); block == nil || block.Type != "RSA PRIVATE KEY" {
+		env.Errorf("expected PKCS#1 PEM, got |%s|", material)
+	}
+
+	if asked != 1 {
+		env.Errorf("the passphrase should be asked once, asked %d times", asked)
+	}
+}
+
+func TestPassphrase_WrongPassphrase(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "id_rsa")
+	writeEncryptedTestKey(env, keyfile, "secret")
+
+	askPassphrase = func(prompt string) (string, error) { return "wrong", nil }
+	defer func() { askPassphrase = AskSecret }()
+
+	if _, err := readRSAKeyMaterial(keyfile, false); !isEncryptedKey(err) {
+		env.Errorf("expected the encrypted key error, got %v", err)
+	}
+
+	auth := AuthMethods{}
+	if err := auth.AddPrivateKey(keyfile); err != nil {
+		env.Fatalf("AddPrivateKey failed: %v", err)
+	}
+	signers, _ := auth.Signers()
+	if _, err := signers[0].Sign(rand.Reader, []byte("data")); err == nil {
+		env.Errorf("expected error for the wrong passphrase")
+	}
+	if signers, _ = auth.Signers(); len(signers) != 0 {
+		env.Errorf("the key that cannot be decrypted should be skipped")
+	}
+}
+
+func TestPassphrase_SkipsUndecryptableKey(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encrypted := filepath.Join(dir, "id_rsa")
+	encryptedPub := writeEncryptedTestKey(env, encrypted, "secret")
+
+	plain := filepath.Join(dir, "id_ed25519")
+	signer, pemBytes := newTestSigner(env)
+	if err := ioutil.WriteFile(plain, pemBytes, 0600); err != nil {
+		env.Fatal(err)
+	}
+
+	askPassphrase = func(prompt string) (string, error) { return "wrong", nil }
+	defer func() { askPassphrase = AskSecret }()
+
+	auth := AuthMethods{}
+	if err := auth.AddPrivateKey(plain); err != nil {
+		env.Fatalf("AddPrivateKey failed: %v", err)
+	}
+	if err := auth.AddPrivateKey(encrypted); err != nil {
+		env.Fatalf("AddPrivateKey failed: %v", err)
+	}
+
+	server := newTestSshServer(env)
+	defer server.Close()
+	server.Configure(func(c *ssh.ServerConfig) {
+		c.NoClientAuth = false
+		c.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), encryptedPub.Marshal()) || bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		}
+	})
+
+	config := testClientConfig()
+	config.Auth = auth.Methods()
+	job := SshJob{Server: server.Addr(), ServerConfig: config}
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+	client, closer, attempts, err := s.connectRetry(&job, 0)
+	if err != nil {
+		env.Fatalf("the key that cannot be decrypted should be skipped: %v", err)
+	}
+	closer()
+	if client == nil || attempts != 1 {
+		env.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
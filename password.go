@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PASSWORD_ENV is the environment variable that has the SSH password.
+const PASSWORD_ENV = "TRITON_PSSH_PASSWORD"
+
+// PasswordFile has the SSH passwords by the instance names and tags.
+type PasswordFile struct {
+	Default    string
+	HasDefault bool
+	Names      map[string]string // by the instance name
+	Tags       []TagPassword     // by the tag, in the order of the file
+}
+
+// TagPassword is the password of the instances that have the tag NAME of
+// VALUE.
+type TagPassword struct {
+	Name     string
+	Value    string
+	Password string
+}
+
+// LoadPasswordFile reads the passwords from FILENAME.  Each line has the
+// form of "KEY PASSWORD", where KEY is an instance name, "tag:NAME=VALUE",
+// or "*" for the other instances.  The line of a single word is the
+// password for the other instances.  Empty lines and the lines starting
+// with '#' are ignored.
+func LoadPasswordFile(filename string) (*PasswordFile, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	bits := stat.Mode().Perm() & (S_IRGRP | S_IWGRP | S_IXGRP | S_IROTH | S_IWOTH | S_IXOTH)
+	if int(bits) != 0 {
+		return nil, fmt.Errorf("wrong permission for the password file: %s", filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	passwords := PasswordFile{Names: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		line = strings.TrimLeft(line, " \t")
+		key, password := "*", line
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, password = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+
+		switch {
+		case key == "*":
+			passwords.Default, passwords.HasDefault = password, true
+		case strings.HasPrefix(key, "tag:"):
+			i := strings.Index(key, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("%s:%d: missing '=' in %s", filename, lineno, key)
+			}
+			passwords.Tags = append(passwords.Tags, TagPassword{Name: key[len("tag:"):i], Value: key[i+1:], Password: password})
+		default:
+			passwords.Names[key] = password
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &passwords, nil
+}
+
+// Lookup returns the password of the instance NAME that has TAGS.
+func (f *PasswordFile) Lookup(name string, tags map[string]interface{}) (string, bool) {
+	if password, ok := f.Names[name]; ok {
+		return password, true
+	}
+	for _, t := range f.Tags {
+		if value, ok := tags[t.Name]; ok && fmt.Sprint(value) == t.Value {
+			return t.Password, true
+		}
+	}
+	return f.Default, f.HasDefault
+}
+
+// askedPassword is the password asked once for the hosts that are not in
+// the password file.
+var askedPassword struct {
+	once     sync.Once
+	password string
+	err      error
+}
+
+// Password returns the SSH password of the instance NAME that has TAGS.  It
+// is taken from the password file, PASSWORD_ENV, or AskSecret() in order.
+func (m *AuthMethods) Password(name string, tags map[string]interface{}) (string, error) {
+	if m.passwords != nil {
+		if password, ok := m.passwords.Lookup(name, tags); ok {
+			return password, nil
+		}
+	}
+	if password, ok := os.LookupEnv(PASSWORD_ENV); ok {
+		return password, nil
+	}
+	askedPassword.once.Do(func() {
+		askedPassword.password, askedPassword.err = AskSecret("password: ")
+	})
+	return askedPassword.password, askedPassword.err
+}
+
+// keyboardInteractive answers the password question with the password of
+// the instance NAME.  The other questions, e.g. the verification code of
+// two-factor authentication, are asked by AskSecret(), or by AskLine() if
+// the server wants them echoed.
+func (m *AuthMethods) keyboardInteractive(name string, tags map[string]interface{}) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			TellUser(fmt.Sprintf("%s@%s: %s", user, name, strings.TrimRight(instruction, "\n")))
+		}
+
+		// The password is given only if it is the single hidden question,
+		// since it cannot tell which one of several is the password.
+		hidden, password := 0, -1
+		for i := range questions {
+			if !echos[i] {
+				hidden, password = hidden+1, i
+			}
+		}
+		if hidden != 1 || !strings.Contains(strings.ToLower(questions[password]), "password") {
+			password = -1
+		}
+
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			var err error
+			prompt := fmt.Sprintf("%s@%s: %s", user, name, question)
+			switch {
+			case i == password:
+				answers[i], err = m.Password(name, tags)
+			case echos[i]:
+				answers[i], err = AskLine(prompt)
+			default:
+				answers[i], err = AskSecret(prompt)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writeTestPasswordFile(env *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	filename := filepath.Join(dir, "passwords")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		env.Fatal(err)
+	}
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestPassword_LoadPasswordFile(env *testing.T) {
+	filename, cleanup := writeTestPasswordFile(env, `# passwords
+kafka1 pass word
+tag:role=zookeeper	zkpass
+* default
+`)
+	defer cleanup()
+
+	passwords, err := LoadPasswordFile(filename)
+	if err != nil {
+		env.Fatalf("LoadPasswordFile failed: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		tags     map[string]interface{}
+		expected string
+	}{
+		{"kafka1", map[string]interface{}{"role": "zookeeper"}, "pass word"},
+		{"zk1", map[string]interface{}{"role": "zookeeper"}, "zkpass"},
+		{"kafka2", nil, "default"},
+	}
+	for _, c := range cases {
+		if password, ok := passwords.Lookup(c.name, c.tags); !ok || password != c.expected {
+			env.Errorf("%s: expected |%s|, got |%s|", c.name, c.expected, password)
+		}
+	}
+
+	filename, cleanup = writeTestPasswordFile(env, "secret\n")
+	defer cleanup()
+	if passwords, err = LoadPasswordFile(filename); err != nil {
+		env.Fatalf("LoadPasswordFile failed: %v", err)
+	}
+	if password, ok := passwords.Lookup("any", nil); !ok || password != "secret" {
+		env.Errorf("expected the default password |secret|, got |%s|", password)
+	}
+
+	os.Chmod(filename, 0644)
+	if _, err := LoadPasswordFile(filename); err == nil {
+		env.Errorf("expected error for the password file readable by others")
+	}
+}
+
+func TestPassword_KeyboardInteractive(env *testing.T) {
+	filename, cleanup := writeTestPasswordFile(env, "host1 secret1\nhost2 secret2\n")
+	defer cleanup()
+
+	auth := AuthMethods{}
+	if err := auth.AddPasswordFile(filename); err != nil {
+		env.Fatalf("AddPasswordFile failed: %v", err)
+	}
+
+	server := newTestSshServer(env)
+	defer server.Close()
+	server.Configure(func(c *ssh.ServerConfig) {
+		c.NoClientAuth = false
+		c.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != "secret2" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		}
+	})
+
+	config := testClientConfig()
+	config.Auth = auth.MethodsFor("host2", nil)
+	client, err := ssh.Dial("tcp", server.Addr(), config)
+	if err != nil {
+		env.Fatalf("cannot authenticate with keyboard-interactive: %v", err)
+	}
+	client.Close()
+
+	config.Auth = auth.MethodsFor("host1", nil)
+	if client, err := ssh.Dial("tcp", server.Addr(), config); err == nil {
+		client.Close()
+		env.Errorf("the password of host1 should be rejected")
+	}
+}
+
+func TestPassword_KeyboardInteractiveQuestions(env *testing.T) {
+	filename, cleanup := writeTestPasswordFile(env, "host1 secret1\n")
+	defer cleanup()
+
+	// the questions that are not the password are answered by SSH_ASKPASS
+	askpass := filepath.Join(filepath.Dir(filename), "askpass")
+	if err := ioutil.WriteFile(askpass, []byte("#!/bin/sh\necho \"answer to $1\"\n"), 0700); err != nil {
+		env.Fatal(err)
+	}
+	for name, value := range map[string]string{"SSH_ASKPASS": askpass, "SSH_ASKPASS_REQUIRE": "force"} {
+		saved, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, saved)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	auth := AuthMethods{}
+	if err := auth.AddPasswordFile(filename); err != nil {
+		env.Fatalf("AddPasswordFile failed: %v", err)
+	}
+	challenge := auth.keyboardInteractive("host1", nil)
+
+	cases := []struct {
+		questions []string
+		echos     []bool
+		expected  []string
+	}{
+		{[]string{"Password: "}, []bool{false}, []string{"secret1"}},
+		{[]string{"Username: ", "Password: "}, []bool{true, false}, []string{"answer to root@host1: Username: ", "secret1"}},
+		{[]string{"Password: ", "Verification code: "}, []bool{false, false}, []string{"answer to root@host1: Password: ", "answer to root@host1: Verification code: "}},
+		{[]string{"Verification code: "}, []bool{false}, []string{"answer to root@host1: Verification code: "}},
+	}
+	for _, c := range cases {
+		answers, err := challenge("root", "Two-factor authentication", c.questions, c.echos)
+		if err != nil {
+			env.Errorf("%q: unexpected error: %v", c.questions, err)
+			continue
+		}
+		if fmt.Sprint(answers) != fmt.Sprint(c.expected) {
+			env.Errorf("%q: expected %q, got %q", c.questions, c.expected, answers)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	l "github.com/cinsk/triton-pssh/log"
+)
+
+// ProxyProgram is the command that ssh(1) runs as ProxyCommand in the
+// command-line print modes.
+var ProxyProgram = "triton-pssh"
+
+// ProxyOptions are the options of ProxyProgram in the ProxyCommand, so
+// that it authenticates to the bastions and verifies their host keys as
+// this process does.  They are recorded by AddProxyOption().
+var ProxyOptions []string
+
+// AddProxyOption records the option OPT to ProxyOptions, if it is one of
+// the authentication, the connection timeout or the host key options.
+// ARGUMENT is the argument of OPT, with the path expanded if any.
+func AddProxyOption(opt *Option, argument string) {
+	switch opt.LongOption {
+	case "agent", "password", "repin":
+		ProxyOptions = append(ProxyOptions, "--"+opt.LongOption)
+	case "identity", "certificate", "password-file", "timeout", "keepalive", "host-key-check":
+		ProxyOptions = append(ProxyOptions, fmt.Sprintf("--%s=%s", opt.LongOption, argument))
+	}
+}
+
+// dialVia connects to ADDR through HOPS, or directly if there is no hop.
+// The returned function must be called after the connection is closed,
+// to release the bastion connection.
+func (s *SshSession) dialVia(hops []SshHop, addr string) (net.Conn, func(), error) {
+	if len(hops) == 0 {
+		conn, err := net.DialTimeout("tcp", addr, s.config.Timeout)
+		return conn, func() {}, err
+	}
+
+	bastion, conn, err := s.bastions.Connect(hops, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { s.bastions.Release(bastion) }, nil
+}
+
+// Proxy connects to ADDR through HOPS, and copies IN to the connection,
+// and the connection to OUT, until the connection is closed.  It works as
+// the ProxyCommand of ssh(1), without requiring nc(1) in the bastion.
+func (s *SshSession) Proxy(hops []SshHop, addr string, in io.Reader, out io.Writer) error {
+	conn, release, err := s.dialVia(hops, addr)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer conn.Close()
+
+	l.Debug("Proxy: connected to %s", addr)
+
+	go func() {
+		n, err := io.Copy(conn, in)
+		l.Debug("Proxy: copying input: %d bytes, err = %v", n, err)
+		closeWrite(conn)
+	}()
+
+	n, err := io.Copy(out, conn)
+	l.Debug("Proxy: copying output: %d bytes, err = %v", n, err)
+	return err
+}
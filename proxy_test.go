@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSshSession_Proxy(env *testing.T) {
+	bastion := newTestSshServer(env)
+	defer bastion.Close()
+
+	service := startEchoService(env)
+	defer service.Close()
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	cases := []struct {
+		name string
+		hops []SshHop
+	}{
+		{"direct", nil},
+		{"bastion", []SshHop{{Address: bastion.Addr(), Config: testClientConfig()}}},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		err := s.Proxy(c.hops, service.Addr().String(), strings.NewReader("hello"), &out)
+		if err != nil {
+			env.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if out.String() != "hello" {
+			env.Errorf("%s: expected |hello|, got |%s|", c.name, out.String())
+		}
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
+	"strings"
 
 	shellquote "github.com/kballard/go-shellquote"
 )
@@ -24,3 +26,85 @@ func ExpandPlaceholder(command []string, repl string) (string, error) {
 	}
 	return shellquote.Join(replaced...), nil
 }
+
+// regexpField matches {NAME} or {NAME:ARG}, optionally preceded by '$' so
+// that the shell variables like ${HOME} can be left untouched, or the
+// escaped form {{NAME}} or {{NAME:ARG}}.
+var regexpField = regexp.MustCompile(`\{\{[A-Za-z_][A-Za-z0-9_]*(:[^{}]+)?\}\}|(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(:([^{}]+))?\}`)
+
+// ExpandFields replaces the placeholders in each word of COMMAND with the
+// fields of the instance in CONTEXT, which is built by buildContext().
+// {NAME} is replaced with the field NAME, e.g. {name}, {id}, {primaryIp}
+// or {image_name}, and {tag:KEY} is replaced with the tag KEY of the
+// instance.  {{NAME}} and {{tag:KEY}} are replaced with {NAME} and
+// {tag:KEY} literally.  Unknown placeholders are left untouched, but a
+// missing tag or a field that is not a scalar value is an error.
+func ExpandFields(command []string, context map[string]interface{}) ([]string, error) {
+	var replaced []string
+	var err error
+
+	for _, word := range command {
+		replaced = append(replaced, regexpField.ReplaceAllStringFunc(word, func(s string) string {
+			if strings.HasPrefix(s, "{{") {
+				inner := s[1 : len(s)-1]
+				match := regexpField.FindStringSubmatch(inner)
+				_, ok := context[match[3]]
+				if (ok && match[4] == "") || (match[3] == "tag" && match[4] != "") {
+					return inner
+				}
+				return s
+			}
+
+			match := regexpField.FindStringSubmatch(s)
+			if match[2] == "$" {
+				return s
+			}
+
+			if match[3] == "tag" && match[4] != "" {
+				tags, _ := context["tags"].(map[string]interface{})
+				value, ok := tags[match[5]]
+				if !ok {
+					if err == nil {
+						err = fmt.Errorf("instance %v has no tag %s", context["name"], match[5])
+					}
+					return s
+				}
+				str, ferr := fieldString(value)
+				if ferr != nil && err == nil {
+					err = fmt.Errorf("cannot expand %s: %s", s, ferr)
+				}
+				return str
+			}
+
+			value, ok := context[match[3]]
+			if !ok || match[4] != "" {
+				return s
+			}
+			str, ferr := fieldString(value)
+			if ferr != nil && err == nil {
+				err = fmt.Errorf("cannot expand %s: %s", s, ferr)
+			}
+			return str
+		}))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// fieldString returns the string form of the scalar VALUE.  The values
+// like lists or maps are rejected, unless they implement fmt.Stringer,
+// e.g. time.Time.
+func fieldString(value interface{}) (string, error) {
+	if _, ok := value.(fmt.Stringer); ok {
+		return fmt.Sprint(value), nil
+	}
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Invalid:
+		return "", fmt.Errorf("no value")
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.Struct, reflect.Ptr, reflect.Interface, reflect.Chan, reflect.Func:
+		return "", fmt.Errorf("not a scalar value")
+	}
+	return fmt.Sprint(value), nil
+}
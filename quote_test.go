@@ -36,3 +36,62 @@ func TestQuote_ExpandPlaceHolder_Expect_Failure(env *testing.T) {
 	}
 
 }
+
+func TestQuote_ExpandFields(env *testing.T) {
+	context := map[string]interface{}{
+		"id":         "70db2402",
+		"name":       "kafka1",
+		"primaryIp":  "10.0.0.1",
+		"image_name": "centos-7",
+		"memory":     1024,
+		"tags":       map[string]interface{}{"role": "kafka", "broker_id": 3},
+		"ips":        []string{"10.0.0.1", "192.168.0.1"},
+	}
+
+	command := []string{"kafka-configs", "--broker", "{tag:broker_id}", "--host={name}.{primaryIp}", "{id}", "{memory}MB",
+		"{image_name}", "{unknown}", "${name}", "{}", "{tag:role}-{tag:role}"}
+	expected := []string{"kafka-configs", "--broker", "3", "--host=kafka1.10.0.0.1", "70db2402", "1024MB",
+		"centos-7", "{unknown}", "${name}", "{}", "kafka-kafka"}
+
+	replaced, err := ExpandFields(command, context)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	if len(replaced) != len(expected) {
+		env.Fatalf("expected %v, got %v", expected, replaced)
+	}
+	for i := range expected {
+		if replaced[i] != expected[i] {
+			env.Errorf("expected |%s|, got |%s|", expected[i], replaced[i])
+		}
+	}
+
+	if _, err := ExpandFields([]string{"echo", "{tag:rack}"}, context); err == nil {
+		env.Errorf("expected error for the missing tag")
+	}
+	for _, word := range []string{"{ips}", "{tags}"} {
+		if _, err := ExpandFields([]string{"echo", word}, context); err == nil {
+			env.Errorf("expected error for the non-scalar field %s", word)
+		}
+	}
+}
+
+func TestQuote_ExpandFields_Escape(env *testing.T) {
+	context := map[string]interface{}{
+		"name": "kafka1",
+		"tags": map[string]interface{}{"role": "kafka"},
+	}
+
+	command := []string{"jq", "{{name}}", "{{tag:role}}-{name}", "{{unknown}}", "{{{name}}}"}
+	expected := []string{"jq", "{name}", "{tag:role}-kafka1", "{{unknown}}", "{{name}}"}
+
+	replaced, err := ExpandFields(command, context)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	for i := range expected {
+		if replaced[i] != expected[i] {
+			env.Errorf("expected |%s|, got |%s|", expected[i], replaced[i])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit status of triton-pssh
+const (
+	EXIT_SUCCESS          = 0
+	EXIT_FAILURE          = 1 // miscellaneous errors
+	EXIT_TIMEOUT          = 3 // at least one host timed out
+	EXIT_CONNECTION_ERROR = 4 // at least one host was not reachable
+	EXIT_REMOTE_FAILURE   = 5 // at least one remote command failed
+	EXIT_NO_MATCH         = 6 // no instance matched
+	EXIT_INTERRUPTED      = 130
+)
+
+type ResultClass int
+
+const (
+	RESULT_SUCCESS ResultClass = iota
+	RESULT_REMOTE_FAILURE
+	RESULT_CONNECTION_ERROR
+	RESULT_TIMEOUT
+	RESULT_LOCAL_ERROR // the job could not be made, e.g. a bad placeholder
+	RESULT_INTERRUPTED // cancelled by a signal
+)
+
+func (c ResultClass) String() string {
+	switch c {
+	case RESULT_SUCCESS:
+		return "success"
+	case RESULT_REMOTE_FAILURE:
+		return "remote failure"
+	case RESULT_CONNECTION_ERROR:
+		return "connection error"
+	case RESULT_TIMEOUT:
+		return "timeout"
+	case RESULT_LOCAL_ERROR:
+		return "local error"
+	case RESULT_INTERRUPTED:
+		return "interrupted"
+	default:
+		return fmt.Sprintf("ResultClass(%d)", int(c))
+	}
+}
+
+// ClassifyStatus returns the class of the job result STATUS.  CONNECTED
+// is true if the connection to the server was made, TRANSFER is true for
+// the file transfer jobs, and TIMEDOUT is true if the job ran out of the
+// deadline.
+func ClassifyStatus(status error, connected bool, transfer bool, timedOut bool) ResultClass {
+	if status == nil {
+		return RESULT_SUCCESS
+	}
+
+	var nerr net.Error
+	if timedOut || (errors.As(status, &nerr) && nerr.Timeout()) {
+		return RESULT_TIMEOUT
+	}
+	if !connected {
+		return RESULT_CONNECTION_ERROR
+	}
+	var eerr *ssh.ExitError
+	if errors.As(status, &eerr) || transfer {
+		return RESULT_REMOTE_FAILURE
+	}
+	// the connection was dropped while running the command
+	return RESULT_CONNECTION_ERROR
+}
+
+// ResultSummary counts the job results by their classes.
+type ResultSummary struct {
+	Counts [RESULT_INTERRUPTED + 1]int
+	Failed [RESULT_INTERRUPTED + 1][]string // host names of the failed jobs
+}
+
+func (r *ResultSummary) Add(result *SshResult) {
+	r.Counts[result.Class]++
+	if result.Class != RESULT_SUCCESS {
+		name := result.InstanceName
+		if name == "" {
+			name = result.InstanceID
+		}
+		r.Failed[result.Class] = append(r.Failed[result.Class], name)
+	}
+}
+
+func (r *ResultSummary) Total() int {
+	total := 0
+	for _, n := range r.Counts {
+		total += n
+	}
+	return total
+}
+
+// ExitCode returns the exit status for the results.  If there are several
+// kinds of failures, interruptions take precedence over timeouts, timeouts
+// take precedence over connection errors, and connection errors take
+// precedence over remote failures.  Local errors only give EXIT_FAILURE
+// if there is no other failure.
+func (r *ResultSummary) ExitCode() int {
+	switch {
+	case r.Total() == 0:
+		return EXIT_NO_MATCH
+	case r.Counts[RESULT_INTERRUPTED] > 0:
+		return EXIT_INTERRUPTED
+	case r.Counts[RESULT_TIMEOUT] > 0:
+		return EXIT_TIMEOUT
+	case r.Counts[RESULT_CONNECTION_ERROR] > 0:
+		return EXIT_CONNECTION_ERROR
+	case r.Counts[RESULT_REMOTE_FAILURE] > 0:
+		return EXIT_REMOTE_FAILURE
+	case r.Counts[RESULT_LOCAL_ERROR] > 0:
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
+}
+
+// Print writes the summary table to OUT.
+func (r *ResultSummary) Print(out io.Writer) {
+	fmt.Fprintf(out, "SUMMARY: %d host(s)\n", r.Total())
+	for c := RESULT_SUCCESS; c <= RESULT_INTERRUPTED; c++ {
+		line := fmt.Sprintf("  %-18s%5d", c.String(), r.Counts[c])
+		if len(r.Failed[c]) > 0 {
+			line += "  " + strings.Join(r.Failed[c], ", ")
+		}
+		fmt.Fprintln(out, line)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testTimeoutError struct{}
+
+func (e testTimeoutError) Error() string   { return "i/o timeout" }
+func (e testTimeoutError) Timeout() bool   { return true }
+func (e testTimeoutError) Temporary() bool { return true }
+
+func TestResult_ClassifyStatus(env *testing.T) {
+	cases := []struct {
+		status    error
+		connected bool
+		transfer  bool
+		timedOut  bool
+		expected  ResultClass
+	}{
+		{nil, true, false, false, RESULT_SUCCESS},
+		{errors.New("connection refused"), false, false, false, RESULT_CONNECTION_ERROR},
+		{testTimeoutError{}, false, false, false, RESULT_TIMEOUT},
+		{errors.New("no such file"), true, true, false, RESULT_REMOTE_FAILURE},
+		{errors.New("remote command exited without exit status"), true, false, false, RESULT_CONNECTION_ERROR},
+		{errors.New("remote command exited without exit status"), true, false, true, RESULT_TIMEOUT},
+	}
+
+	for i, c := range cases {
+		if class := ClassifyStatus(c.status, c.connected, c.transfer, c.timedOut); class != c.expected {
+			env.Errorf("case %d: expected %v, got %v", i, c.expected, class)
+		}
+	}
+}
+
+func TestResult_Summary(env *testing.T) {
+	summary := ResultSummary{}
+	if code := summary.ExitCode(); code != EXIT_NO_MATCH {
+		env.Errorf("expected %d for no result, got %d", EXIT_NO_MATCH, code)
+	}
+
+	summary.Add(&SshResult{InstanceName: "kafka1", Class: RESULT_SUCCESS})
+	if code := summary.ExitCode(); code != EXIT_SUCCESS {
+		env.Errorf("expected %d, got %d", EXIT_SUCCESS, code)
+	}
+
+	summary.Add(&SshResult{InstanceName: "kafka6", Class: RESULT_LOCAL_ERROR})
+	if code := summary.ExitCode(); code != EXIT_FAILURE {
+		env.Errorf("expected %d, got %d", EXIT_FAILURE, code)
+	}
+
+	summary.Add(&SshResult{InstanceName: "kafka2", Class: RESULT_REMOTE_FAILURE})
+	summary.Add(&SshResult{InstanceName: "kafka3", Class: RESULT_REMOTE_FAILURE})
+	if code := summary.ExitCode(); code != EXIT_REMOTE_FAILURE {
+		env.Errorf("expected %d, got %d", EXIT_REMOTE_FAILURE, code)
+	}
+
+	summary.Add(&SshResult{InstanceID: "70db2402", Class: RESULT_CONNECTION_ERROR})
+	if code := summary.ExitCode(); code != EXIT_CONNECTION_ERROR {
+		env.Errorf("expected %d, got %d", EXIT_CONNECTION_ERROR, code)
+	}
+
+	summary.Add(&SshResult{InstanceName: "kafka5", Class: RESULT_TIMEOUT})
+	if code := summary.ExitCode(); code != EXIT_TIMEOUT {
+		env.Errorf("expected %d, got %d", EXIT_TIMEOUT, code)
+	}
+
+	out := bytes.Buffer{}
+	summary.Print(&out)
+	for _, line := range []string{"6 host(s)", "kafka2, kafka3", "70db2402", "kafka5", "kafka6"} {
+		if !strings.Contains(out.String(), line) {
+			env.Errorf("expected |%s| in the summary, got |%s|", line, out.String())
+		}
+	}
+}
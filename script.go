@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	l "github.com/cinsk/triton-pssh/log"
+	shellquote "github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// SCRIPT_UPLOAD writes the standard input to a new temporary directory as
+// "sh -c SCRIPT_UPLOAD triton-pssh NAME", and prints the directory.
+const SCRIPT_UPLOAD = `umask 077 && d=$(mktemp -d "${TMPDIR:-/tmp}/triton-pssh-XXXXXXXX") && ` +
+	`cat > "$d/$1" && chmod 700 "$d/$1" && echo "$d"`
+
+// ScriptSpec is a local script that is uploaded to each server and run
+// with the arguments of SshJob.Command.
+type ScriptSpec struct {
+	Name        string   // the base name of the script
+	Content     []byte   // the content of the script
+	Interpreter []string // the program (and its options) to run the script; empty to run it directly
+}
+
+// SCRIPT_WRAPPER runs the script as "sh -c SCRIPT_WRAPPER triton-pssh DIR
+// COMMAND...".  It leaves a watcher that removes DIR when the command
+// exits, so that the script is removed even if the connection is closed on
+// the timeout or the interruption.  The command replaces the shell, so
+// that it gets the signals and the input as it is.
+const SCRIPT_WRAPPER = `d=$1; shift; ` +
+	`(trap '' HUP INT TERM; while kill -0 $$ 2>/dev/null; do sleep 1; done; rm -rf "$d") </dev/null >/dev/null 2>&1 & ` +
+	`exec "$@"`
+
+// NewScriptSpec reads the script FILENAME.  INTERPRETER may have options,
+// e.g. "bash -x".
+func NewScriptSpec(filename string, interpreter string) (*ScriptSpec, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	words, err := shellquote.Split(interpreter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interpreter %s: %s", interpreter, err)
+	}
+
+	return &ScriptSpec{
+		Name:        filepath.Base(filename),
+		Content:     content,
+		Interpreter: words,
+	}, nil
+}
+
+// CheckScriptSudoUser returns an error if the script cannot be run as
+// SUDOUSER.  The temporary directory of the script is private to the login
+// user, so only root (or the login user itself, without sudo) can read it
+// and remove it afterwards.
+func CheckScriptSudoUser(sudoUser string) error {
+	if sudoUser != "" && sudoUser != "root" && sudoUser != "#0" {
+		return fmt.Errorf("the script cannot be run as %s, which cannot read the private temporary directory of the login user", sudoUser)
+	}
+	return nil
+}
+
+// Path returns the remote path of the script in the remote directory DIR.
+func (s *ScriptSpec) Path(dir string) string {
+	return path.Join(dir, s.Name)
+}
+
+// Command returns the command that runs the script in the remote directory
+// DIR with ARGS.  DIR is removed when the command exits.
+func (s *ScriptSpec) Command(dir string, args []string) []string {
+	command := []string{"sh", "-c", SCRIPT_WRAPPER, "triton-pssh", dir}
+	command = append(command, s.Interpreter...)
+	command = append(command, s.Path(dir))
+	return append(command, args...)
+}
+
+// uploadScript writes SCRIPT to a new temporary directory of the server
+// through CLIENT, and returns the directory.  The directory is made by
+// mktemp(1) in $TMPDIR or /tmp, and only the user can access it.
+func (s *SshSession) uploadScript(client *ssh.Client, script *ScriptSpec) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(script.Content)
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	// sh(1), since the login shell may not be a Bourne shell
+	err = session.Run(shellquote.Join("sh", "-c", SCRIPT_UPLOAD, "triton-pssh", script.Name))
+	if err != nil {
+		return "", fmt.Errorf("cannot upload script %s: %w: %s", script.Name, err, strings.TrimSpace(stderr.String()))
+	}
+	dir := strings.TrimSpace(stdout.String())
+	if !path.IsAbs(dir) {
+		return "", fmt.Errorf("cannot upload script %s: invalid directory %q", script.Name, dir)
+	}
+	return dir, nil
+}
+
+// removeScript removes the remote directory DIR, e.g. if the command did
+// not start.  Errors are ignored, since the connection may be already
+// closed; the wrapper of the command removes DIR then.
+func (s *SshSession) removeScript(client *ssh.Client, dir string) {
+	session, err := client.NewSession()
+	if err != nil {
+		l.Debug("removeScript: cannot remove %s: %v", dir, err)
+		return
+	}
+	defer session.Close()
+
+	if err := session.Run(fmt.Sprintf("rm -rf %s", shellquote.Join(dir))); err != nil {
+		l.Debug("removeScript: cannot remove %s: %v", dir, err)
+	}
+}
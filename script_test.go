@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScript_NewScriptSpec(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "check.sh")
+	if err := ioutil.WriteFile(filename, []byte("#!/bin/sh\necho ok\n"), 0644); err != nil {
+		env.Fatal(err)
+	}
+
+	script, err := NewScriptSpec(filename, "bash -x")
+	if err != nil {
+		env.Fatalf("NewScriptSpec failed: %v", err)
+	}
+	if string(script.Content) != "#!/bin/sh\necho ok\n" {
+		env.Errorf("unexpected content: |%s|", script.Content)
+	}
+	if script.Path("/tmp/triton-pssh-x") != "/tmp/triton-pssh-x/check.sh" {
+		env.Errorf("unexpected path: %s", script.Path("/tmp/triton-pssh-x"))
+	}
+
+	expected := []string{"sh", "-c", SCRIPT_WRAPPER, "triton-pssh", "/tmp/triton-pssh-x", "bash", "-x", "/tmp/triton-pssh-x/check.sh", "a b", "c"}
+	if got := script.Command("/tmp/triton-pssh-x", []string{"a b", "c"}); !reflect.DeepEqual(got, expected) {
+		env.Errorf("expected %v, got %v", expected, got)
+	}
+
+	other, err := NewScriptSpec(filename, "")
+	if err != nil {
+		env.Fatalf("NewScriptSpec failed: %v", err)
+	}
+	if got := other.Command("/tmp/d", nil); !reflect.DeepEqual(got[5:], []string{"/tmp/d/check.sh"}) {
+		env.Errorf("expected [/tmp/d/check.sh], got %v", got[5:])
+	}
+
+	if _, err := NewScriptSpec(filepath.Join(dir, "nonexistent"), ""); err == nil {
+		env.Errorf("expected error for the nonexistent script")
+	}
+	if _, err := NewScriptSpec(filename, "bash 'unterminated"); err == nil {
+		env.Errorf("expected error for the invalid interpreter")
+	}
+}
+
+// waitRemoved returns true if DIR is removed in a few seconds.
+func waitRemoved(dir string) bool {
+	for i := 0; i < 50; i++ {
+		if !IsExist(dir) {
+			return true
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+	return false
+}
+
+func TestScript_CheckScriptSudoUser(env *testing.T) {
+	for _, user := range []string{"", "root", "#0"} {
+		if err := CheckScriptSudoUser(user); err != nil {
+			env.Errorf("unexpected error for sudo user %q: %v", user, err)
+		}
+	}
+	for _, user := range []string{"postgres", "ubuntu"} {
+		if err := CheckScriptSudoUser(user); err == nil {
+			env.Errorf("expected error for sudo user %q", user)
+		}
+	}
+}
+
+func TestScript_Wrapper(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "args.sh")
+	if err := ioutil.WriteFile(filename, []byte("echo \"$# $1\"; cat\n"), 0700); err != nil {
+		env.Fatal(err)
+	}
+	script := &ScriptSpec{Name: "args.sh", Interpreter: []string{"sh"}}
+
+	words := script.Command(dir, []string{"a b", "c"})
+	cmd := exec.Command(words[0], words[1:]...)
+	cmd.Stdin = strings.NewReader("input\n")
+	out, err := cmd.Output()
+	if err != nil {
+		env.Fatalf("the wrapper failed: %v", err)
+	}
+	if string(out) != "2 a b\ninput\n" {
+		env.Errorf("expected |2 a b\\ninput\\n|, got |%s|", out)
+	}
+	if !waitRemoved(dir) {
+		env.Errorf("the directory should be removed after the script exits")
+	}
+
+	// the script that is killed, e.g. on the timeout
+	if err := os.Mkdir(dir, 0700); err != nil {
+		env.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("sleep 60\n"), 0700); err != nil {
+		env.Fatal(err)
+	}
+	words = script.Command(dir, nil)
+	cmd = exec.Command(words[0], words[1:]...)
+	if err := cmd.Start(); err != nil {
+		env.Fatal(err)
+	}
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	cmd.Process.Kill()
+	cmd.Wait()
+	if !waitRemoved(dir) {
+		env.Errorf("the directory should be removed after the script is killed")
+	}
+}
+
+func TestScript_Upload(env *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cmd := exec.Command("sh", "-c", SCRIPT_UPLOAD, "triton-pssh", "check it.sh")
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpdir)
+	cmd.Stdin = strings.NewReader("echo ok\n")
+	out, err := cmd.Output()
+	if err != nil {
+		env.Fatalf("the upload failed: %v", err)
+	}
+
+	dir := strings.TrimSpace(string(out))
+	if filepath.Dir(dir) != tmpdir || !strings.HasPrefix(filepath.Base(dir), "triton-pssh-") {
+		env.Errorf("expected a new directory in %s, got %s", tmpdir, dir)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "check it.sh"))
+	if err != nil || string(content) != "echo ok\n" {
+		env.Errorf("unexpected content |%s|, %v", content, err)
+	}
+	if stat, err := os.Stat(dir); err != nil || stat.Mode().Perm() != 0700 {
+		env.Errorf("the directory should be private: %v", err)
+	}
+}
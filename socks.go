@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_SOCKS_PORT = 1080
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	SOCKS_VERSION         = 0x05
+	SOCKS_METHOD_NO_AUTH  = 0x00
+	SOCKS_METHOD_REJECTED = 0xff
+	SOCKS_CMD_CONNECT     = 0x01
+	SOCKS_ATYP_IPV4       = 0x01
+	SOCKS_ATYP_DOMAIN     = 0x03
+	SOCKS_ATYP_IPV6       = 0x04
+
+	SOCKS_REP_SUCCESS            = 0x00
+	SOCKS_REP_FAILURE            = 0x01
+	SOCKS_REP_HOST_UNREACHABLE   = 0x04
+	SOCKS_REP_CONNECTION_REFUSED = 0x05
+	SOCKS_REP_CMD_UNSUPPORTED    = 0x07
+	SOCKS_REP_ATYP_UNSUPPORTED   = 0x08
+)
+
+// SocksServer is a local SOCKS5 proxy, which connects to the targets
+// through the bastion servers.  The instance names are resolved to their
+// primary IP addresses, and the other names are resolved by the last
+// bastion.  If HttpConnect is true, it accepts HTTP CONNECT requests on
+// the same port as well.
+type SocksServer struct {
+	Listener    net.Listener
+	HttpConnect bool
+
+	names map[string]string // instance name -> primary IP
+	dial  func(addr string) (net.Conn, func(), error)
+}
+
+// OpenSocks starts a SOCKS5 proxy listening on LISTEN address, which
+// connects through HOPS.  NAMES maps the instance names to their addresses.
+func (s *SshSession) OpenSocks(hops []SshHop, listen string, names map[string]string, httpConnect bool) (*SocksServer, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &SocksServer{
+		Listener:    ln,
+		HttpConnect: httpConnect,
+		names:       names,
+		dial: func(addr string) (net.Conn, func(), error) {
+			return s.dialVia(hops, addr)
+		},
+	}
+	go server.serve()
+	return server, nil
+}
+
+func (p *SocksServer) serve() {
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			l.Debug("Socks: listener %s closed: %v", p.Listener.Addr(), err)
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+// Resolve replaces the host part of ADDR with the primary IP address if it
+// is the name of an instance.
+func (p *SocksServer) Resolve(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip, ok := p.names[host]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
+
+func (p *SocksServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if b[0] == SOCKS_VERSION {
+		p.handleSocks(&bufferedConn{conn, r})
+	} else if p.HttpConnect {
+		p.handleHttp(&bufferedConn{conn, r})
+	} else {
+		l.Debug("Socks: unknown protocol from %s", conn.RemoteAddr())
+	}
+}
+
+func (p *SocksServer) handleSocks(conn *bufferedConn) {
+	addr, err := readSocksRequest(conn)
+	if err != nil {
+		l.Debug("Socks: invalid request from %s: %v", conn.RemoteAddr(), err)
+		if rep, ok := err.(socksError); ok {
+			writeSocksReply(conn, byte(rep))
+		}
+		return
+	}
+
+	remote, release, err := p.dial(p.Resolve(addr))
+	if err != nil {
+		l.Warn("cannot connect to %s: %s", addr, err)
+		writeSocksReply(conn, socksReplyOf(err))
+		return
+	}
+	defer release()
+	defer remote.Close()
+
+	if err := writeSocksReply(conn, SOCKS_REP_SUCCESS); err != nil {
+		return
+	}
+	l.Debug("Socks: forwarding %s to %s", conn.RemoteAddr(), addr)
+	pipe(conn, remote)
+}
+
+func (p *SocksServer) handleHttp(conn *bufferedConn) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		l.Debug("Socks: invalid HTTP request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprintf(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	remote, release, err := p.dial(p.Resolve(addr))
+	if err != nil {
+		l.Warn("cannot connect to %s: %s", addr, err)
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer release()
+	defer remote.Close()
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	l.Debug("Socks: forwarding %s to %s (HTTP)", conn.RemoteAddr(), addr)
+	pipe(conn, remote)
+}
+
+func (p *SocksServer) Close() {
+	p.Listener.Close()
+}
+
+// socksError is an error that should be replied to the client with the
+// reply code.
+type socksError byte
+
+func (e socksError) Error() string {
+	return fmt.Sprintf("SOCKS error 0x%02x", byte(e))
+}
+
+// readSocksRequest reads the method negotiation and the CONNECT request
+// from CONN, and returns the requested address in HOST:PORT.
+func readSocksRequest(conn io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != SOCKS_VERSION {
+		return "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(SOCKS_METHOD_REJECTED)
+	for _, m := range methods {
+		if m == SOCKS_METHOD_NO_AUTH {
+			method = SOCKS_METHOD_NO_AUTH
+		}
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, method}); err != nil {
+		return "", err
+	}
+	if method == SOCKS_METHOD_REJECTED {
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != SOCKS_VERSION {
+		return "", fmt.Errorf("unsupported version %d", req[0])
+	}
+	if req[1] != SOCKS_CMD_CONNECT {
+		return "", socksError(SOCKS_REP_CMD_UNSUPPORTED)
+	}
+
+	var host string
+	switch req[3] {
+	case SOCKS_ATYP_IPV4, SOCKS_ATYP_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == SOCKS_ATYP_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case SOCKS_ATYP_DOMAIN:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", socksError(SOCKS_REP_ATYP_UNSUPPORTED)
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSocksReply writes the reply of the CONNECT request.  The bound
+// address is not meaningful for the connections through the bastion, so
+// it is always 0.0.0.0:0.
+func writeSocksReply(conn io.Writer, rep byte) error {
+	_, err := conn.Write([]byte{SOCKS_VERSION, rep, 0x00, SOCKS_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socksReplyOf(err error) byte {
+	if oe, ok := err.(*ssh.OpenChannelError); ok && oe.Reason == ssh.ConnectionFailed {
+		return SOCKS_REP_CONNECTION_REFUSED
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return SOCKS_REP_HOST_UNREACHABLE
+	}
+	return SOCKS_REP_FAILURE
+}
+
+// bufferedConn is a connection whose input is read through a buffer, so
+// that the protocol can be detected before it is handled.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// startEchoService starts the service that echoes the input back.
+func startEchoService(env *testing.T) net.Listener {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return service
+}
+
+// socksConnect sends the SOCKS5 CONNECT request for HOST:PORT to CONN, and
+// returns the reply code.
+func socksConnect(env *testing.T, conn net.Conn, host string, port int) byte {
+	conn.Write([]byte{SOCKS_VERSION, 1, SOCKS_METHOD_NO_AUTH})
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		env.Fatalf("cannot read the method: %v", err)
+	}
+	if method[1] != SOCKS_METHOD_NO_AUTH {
+		env.Fatalf("expected method 0x00, got 0x%02x", method[1])
+	}
+
+	req := []byte{SOCKS_VERSION, SOCKS_CMD_CONNECT, 0x00, SOCKS_ATYP_DOMAIN, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write(req)
+
+	var reply [10]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		env.Fatalf("cannot read the reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestSocksServer_Connect(env *testing.T) {
+	bastion := newTestSshServer(env)
+	defer bastion.Close()
+	service := startEchoService(env)
+	defer service.Close()
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	host, portstr, _ := net.SplitHostPort(service.Addr().String())
+	port, _ := strconv.Atoi(portstr)
+
+	hops := []SshHop{{Address: bastion.Addr(), Config: testClientConfig()}}
+	socks, err := s.OpenSocks(hops, "127.0.0.1:0", map[string]string{"nexus": host}, true)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	defer socks.Close()
+
+	// SOCKS5, with the instance name
+	conn, err := net.Dial("tcp", socks.Listener.Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the proxy: %v", err)
+	}
+	if rep := socksConnect(env, conn, "nexus", port); rep != SOCKS_REP_SUCCESS {
+		env.Fatalf("expected reply 0x00, got 0x%02x", rep)
+	}
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	out, _ := ioutil.ReadAll(conn)
+	if string(out) != "hello" {
+		env.Errorf("expected |hello|, got |%s|", out)
+	}
+	conn.Close()
+
+	// HTTP CONNECT
+	conn, err = net.Dial("tcp", socks.Listener.Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the proxy: %v", err)
+	}
+	conn.Write([]byte("CONNECT nexus:" + portstr + " HTTP/1.1\r\nHost: nexus:" + portstr + "\r\n\r\nhello"))
+	conn.(*net.TCPConn).CloseWrite()
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		env.Fatalf("cannot read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		env.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	out, _ = ioutil.ReadAll(r)
+	if string(out) != "hello" {
+		env.Errorf("expected |hello|, got |%s|", out)
+	}
+	conn.Close()
+}
+
+func TestSocksServer_Refused(env *testing.T) {
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	// find a port that nobody is listening on
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, portstr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portstr)
+	ln.Close()
+
+	socks, err := s.OpenSocks(nil, "127.0.0.1:0", nil, false)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	defer socks.Close()
+
+	conn, err := net.Dial("tcp", socks.Listener.Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	if rep := socksConnect(env, conn, "127.0.0.1", port); rep == SOCKS_REP_SUCCESS {
+		env.Errorf("expected failure, got 0x%02x", rep)
+	}
+
+	// HTTP CONNECT is not accepted
+	conn2, err := net.Dial("tcp", socks.Listener.Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the proxy: %v", err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("CONNECT localhost:80 HTTP/1.1\r\n\r\n"))
+	if out, _ := ioutil.ReadAll(conn2); len(out) != 0 {
+		env.Errorf("expected no response, got |%s|", out)
+	}
+}
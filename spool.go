@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+
+	l "github.com/cinsk/triton-pssh/log"
+)
+
+// SPOOL_THRESHOLD is the size of the output that is kept in memory.  The
+// larger output is spooled to a temporary file.
+const SPOOL_THRESHOLD = 64 * 1024
+
+// Spool keeps the output of a command.  The first SPOOL_THRESHOLD bytes are
+// kept in memory, and the rest in a temporary file, so that the memory
+// usage stays bounded regardless of the output size.  If Max is positive,
+// only the first and the last Max/2 bytes are kept, and the truncated part
+// is replaced with a marker on reading.
+type Spool struct {
+	Max int64
+
+	mem     []byte
+	file    *os.File
+	written int64 // total bytes given to Write()
+	err     error // the first error of the temporary file
+}
+
+func NewSpool(max int64) *Spool {
+	return &Spool{Max: max}
+}
+
+func (s *Spool) headSize() int64 {
+	return s.Max / 2
+}
+
+func (s *Spool) tailSize() int64 {
+	return s.Max - s.Max/2
+}
+
+// Write never fails, so that the command is not blocked by a full disk.
+// The errors are reported in the output instead.
+func (s *Spool) Write(p []byte) (int, error) {
+	total := len(p)
+
+	for len(p) > 0 {
+		var off, n int64
+
+		n = int64(len(p))
+		if s.Max <= 0 || s.written < s.headSize() {
+			off = s.written
+			if s.Max > 0 && n > s.headSize()-s.written {
+				n = s.headSize() - s.written
+			}
+		} else {
+			// the tail is kept in a ring after the head
+			r := (s.written - s.headSize()) % s.tailSize()
+			off = s.headSize() + r
+			if n > s.tailSize()-r {
+				n = s.tailSize() - r
+			}
+		}
+
+		s.writeAt(p[:n], off)
+		p = p[n:]
+		s.written += n
+	}
+	return total, nil
+}
+
+func (s *Spool) writeAt(data []byte, off int64) {
+	if s.err != nil {
+		return
+	}
+
+	end := off + int64(len(data))
+	if s.file == nil && end > SPOOL_THRESHOLD {
+		f, err := ioutil.TempFile("", "triton-pssh-spool")
+		if err != nil {
+			s.err = err
+			return
+		}
+		l.Debug("Spool: spooling to %s", f.Name())
+		if _, err := f.Write(s.mem); err != nil {
+			s.err = err
+		}
+		s.file, s.mem = f, nil
+	}
+
+	if s.file != nil {
+		if _, err := s.file.WriteAt(data, off); err != nil && s.err == nil {
+			s.err = err
+		}
+		return
+	}
+
+	if end > int64(len(s.mem)) {
+		s.mem = append(s.mem, make([]byte, end-int64(len(s.mem)))...)
+	}
+	copy(s.mem[off:], data)
+}
+
+// Len returns the total size of the output, including the truncated part.
+func (s *Spool) Len() int64 {
+	return s.written
+}
+
+// Truncated returns true if a part of the output was dropped by Max.
+func (s *Spool) Truncated() bool {
+	return s.Max > 0 && s.written > s.Max
+}
+
+func (s *Spool) copyRange(w io.Writer, off int64, n int64) (int64, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	if s.file != nil {
+		return io.Copy(w, io.NewSectionReader(s.file, off, n))
+	}
+	m, err := w.Write(s.mem[off : off+n])
+	return int64(m), err
+}
+
+// WriteTo writes the kept output to W, with the truncation marker if any.
+func (s *Spool) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
+	write := func(n int64, err error) error {
+		total += n
+		return err
+	}
+
+	if !s.Truncated() {
+		if err := write(s.copyRange(w, 0, s.written)); err != nil {
+			return total, err
+		}
+	} else {
+		head, tail := s.headSize(), s.tailSize()
+		r := (s.written - head) % tail
+
+		if err := write(s.copyRange(w, 0, head)); err != nil {
+			return total, err
+		}
+		m, err := fmt.Fprintf(w, "\n[... %d bytes truncated ...]\n", s.written-s.Max)
+		if err := write(int64(m), err); err != nil {
+			return total, err
+		}
+		if err := write(s.copyRange(w, head+r, tail-r)); err != nil {
+			return total, err
+		}
+		if err := write(s.copyRange(w, head, r)); err != nil {
+			return total, err
+		}
+	}
+
+	if s.err != nil {
+		m, err := fmt.Fprintf(w, "\n[... output lost: %v ...]\n", s.err)
+		if err := write(int64(m), err); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *Spool) Bytes() []byte {
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func (s *Spool) String() string {
+	return string(s.Bytes())
+}
+
+// Close removes the temporary file.
+func (s *Spool) Close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+	s.mem = nil
+}
+
+// ParseSize parses S as the number of bytes, optionally with the suffix of
+// K, M or G (in 1024).
+func ParseSize(s string) (int64, error) {
+	num, unit := s, int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1024
+		case 'm', 'M':
+			unit = 1024 * 1024
+		case 'g', 'G':
+			unit = 1024 * 1024 * 1024
+		}
+		if unit > 1 {
+			num = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
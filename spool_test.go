@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool_Memory(env *testing.T) {
+	s := NewSpool(0)
+	defer s.Close()
+
+	s.Write([]byte("hello\n"))
+	s.Write([]byte("world\n"))
+
+	if s.file != nil {
+		env.Errorf("small output should not be spooled")
+	}
+	if s.String() != "hello\nworld\n" {
+		env.Errorf("expected |hello\\nworld\\n|, got |%s|", s.String())
+	}
+	if s.Len() != 12 {
+		env.Errorf("expected length 12, got %d", s.Len())
+	}
+}
+
+func TestSpool_File(env *testing.T) {
+	s := NewSpool(0)
+
+	data := []byte(strings.Repeat("0123456789abcdef", SPOOL_THRESHOLD/8))
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		s.Write(data[i:end])
+	}
+
+	if s.file == nil {
+		env.Fatalf("large output should be spooled")
+	}
+	name := s.file.Name()
+
+	out := bytes.Buffer{}
+	s.WriteTo(&out)
+	if !bytes.Equal(out.Bytes(), data) {
+		env.Errorf("spooled output differs: %d bytes, expected %d bytes", out.Len(), len(data))
+	}
+
+	s.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		env.Errorf("spool file %s should be removed: %v", name, err)
+	}
+}
+
+func TestSpool_Truncate(env *testing.T) {
+	s := NewSpool(10)
+	defer s.Close()
+
+	for _, chunk := range []string{"012", "345", "678", "9ab", "cde", "fgh", "ij"} {
+		s.Write([]byte(chunk))
+	}
+
+	expected := "01234\n[... 10 bytes truncated ...]\nfghij"
+	if s.String() != expected {
+		env.Errorf("expected |%s|, got |%s|", expected, s.String())
+	}
+
+	s = NewSpool(10)
+	defer s.Close()
+	s.Write([]byte("0123456789"))
+	if s.Truncated() || s.String() != "0123456789" {
+		env.Errorf("expected |0123456789| without truncation, got |%s|", s.String())
+	}
+}
+
+func TestSpool_TruncateFile(env *testing.T) {
+	max := int64(SPOOL_THRESHOLD * 4)
+	s := NewSpool(max)
+	defer s.Close()
+
+	data := []byte(strings.Repeat("0123456789abcdef", SPOOL_THRESHOLD))
+	for i := 0; i < len(data); i += 999 {
+		end := i + 999
+		if end > len(data) {
+			end = len(data)
+		}
+		s.Write(data[i:end])
+	}
+
+	head := data[:max/2]
+	tail := data[int64(len(data))-max/2:]
+	out := s.Bytes()
+	if !bytes.HasPrefix(out, head) || !bytes.HasSuffix(out, tail) {
+		env.Errorf("truncated output does not have the head and the tail")
+	}
+	if !bytes.Contains(out, []byte("bytes truncated")) {
+		env.Errorf("truncated output does not have the marker")
+	}
+}
+
+func TestSpool_ParseSize(env *testing.T) {
+	cases := map[string]int64{
+		"100": 100,
+		"4k":  4096,
+		"2M":  2 * 1024 * 1024,
+		"1G":  1024 * 1024 * 1024,
+		"8G":  8 * 1024 * 1024 * 1024,
+	}
+	for arg, expected := range cases {
+		n, err := ParseSize(arg)
+		if err != nil || n != expected {
+			env.Errorf("ParseSize(%s): expected %d, got %d, %v", arg, expected, n, err)
+		}
+	}
+	for _, arg := range []string{"", "K", "-1", "1T", "9999999999G", "9223372036854775807K"} {
+		if _, err := ParseSize(arg); err == nil {
+			env.Errorf("ParseSize(%s): expected error", arg)
+		}
+	}
+}
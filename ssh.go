@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,12 +11,15 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	l "github.com/cinsk/triton-pssh/log"
 	"github.com/joyent/triton-go/compute"
 	shellquote "github.com/kballard/go-shellquote"
+	"github.com/logrusorgru/aurora"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 type PrintConfMode int
@@ -27,12 +31,17 @@ const (
 	MODE_RSYNC
 )
 
+// SshHop is a server that the connection goes through.
+type SshHop struct {
+	Address string // host:port
+	Config  *ssh.ClientConfig
+}
+
 type SshJob struct {
-	ServerConfig  *ssh.ClientConfig
-	BastionConfig *ssh.ClientConfig
+	ServerConfig *ssh.ClientConfig
+	Server       string
 
-	Server  string
-	Bastion string
+	Bastions []SshHop // ordered from the nearest; empty if no bastion is needed
 
 	InstanceName string
 	InstanceID   string
@@ -43,6 +52,9 @@ type SshJob struct {
 
 	Command []string
 
+	Transfer *TransferSpec // non-nil if the job transfers files instead of Command
+	Script   *ScriptSpec   // non-nil if the job runs the script with Command as the arguments
+
 	DryRun bool
 	Result chan SshResult
 }
@@ -59,23 +71,62 @@ type SshResult struct {
 	InstanceID   string
 	User         string
 
-	Stdout *bytes.Buffer
-	Stderr *bytes.Buffer
+	Bastion string // bastion chain, empty if the server is reached directly
+
+	Stdout *Spool
+	Stderr *Spool
+
+	StdoutFile string // the file in OutDirectory that has the output
+	StderrFile string // the file in ErrDirectory that has the error output
 
+	Files int   // number of transferred files
+	Bytes int64 // number of transferred bytes
+
+	Attempts int // number of connection attempts
+
+	Class ResultClass
+
+	Start  time.Time
 	Time   time.Time
 	Status error
 }
 
+// Close releases the spooled outputs of the result.
+func (r *SshResult) Close() {
+	if r.Stdout != nil {
+		r.Stdout.Close()
+	}
+	if r.Stderr != nil {
+		r.Stderr.Close()
+	}
+}
+
 type SshSession struct {
 	config *TsshConfig
 	input  chan *SshJob
 
 	workerGroup sync.WaitGroup
 	nworkers    int
+
+	stream   *StreamPrinter // non-nil in the streaming output mode
+	bastions *BastionPool
+
+	cancel     chan struct{} // closed by Cancel()
+	cancelOnce sync.Once
+	signal     ssh.Signal // the signal sent to the running commands on Cancel()
 }
 
+// CANCEL_GRACE_PERIOD is the time to wait for the running commands to exit
+// after sending the signal on Cancel().
+const CANCEL_GRACE_PERIOD = time.Duration(5) * time.Second
+
 func NewSshSession(config *TsshConfig, nworkers int) *SshSession {
-	session := SshSession{config: config, input: make(chan *SshJob)}
+	session := SshSession{config: config, input: make(chan *SshJob), cancel: make(chan struct{})}
+	session.bastions = NewBastionPool(config.BastionMaxChannels, session.dialBastions)
+
+	if config.StreamOutput {
+		session.stream = NewStreamPrinter(aurora.NewAurora(terminal.IsTerminal(int(syscall.Stdout))))
+	}
 
 	for i := 0; i < nworkers; i++ {
 		session.workerGroup.Add(1)
@@ -98,25 +149,20 @@ func (s *SshSession) BuildJob(instance *compute.Instance, config *TsshConfig, co
 	job := SshJob{}
 
 	job.ServerConfig = &ssh.ClientConfig{
-		User:            user,
-		Auth:            config.Auth.Methods(),
-		Timeout:         s.config.Timeout,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil },
+		User:              user,
+		Auth:              config.Auth.MethodsFor(instance.Name, instance.Tags),
+		Timeout:           s.config.Timeout,
+		HostKeyCallback:   HostKeys.Callback(instance.ID, instance.Name),
+		HostKeyAlgorithms: HostKeys.Algorithms(instance.ID),
 	}
 	job.Server = fmt.Sprintf("%s:%d", instance.PrimaryIP, s.config.ServerPort)
 
-	if !public && s.config.BastionAddress == "" {
+	if !public && len(s.config.Bastions) == 0 {
 		return nil, fmt.Errorf("cannot connect to the instance(%s) without bastion server", instance.Name)
 	}
 
 	if !public || config.ForceBastionOnPublicHost {
-		job.BastionConfig = &ssh.ClientConfig{
-			User:            s.config.BastionUser,
-			Auth:            config.Auth.Methods(),
-			Timeout:         s.config.Timeout,
-			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil },
-		}
-		job.Bastion = fmt.Sprintf("%s:%d", s.config.BastionAddress, s.config.BastionPort)
+		job.Bastions = s.BastionHops(config)
 	}
 
 	job.Command = command
@@ -137,13 +183,93 @@ func (s *SshSession) BuildJob(instance *compute.Instance, config *TsshConfig, co
 	return &job, nil
 }
 
-func (s *SshSession) Run(job *SshJob) {
-	s.input <- job
+// BastionHops returns the chain of the bastion servers in CONFIG.
+func (s *SshSession) BastionHops(config *TsshConfig) []SshHop {
+	var hops []SshHop
+
+	for _, hop := range config.Bastions {
+		bastionID := hop.ID
+		if bastionID == "" {
+			bastionID = hop.Address
+		}
+		hops = append(hops, SshHop{
+			Address: fmt.Sprintf("%s:%d", hop.Address, hop.Port),
+			Config: &ssh.ClientConfig{
+				User:              hop.User,
+				Auth:              config.Auth.MethodsFor(hop.Name, nil),
+				Timeout:           s.config.Timeout,
+				HostKeyCallback:   HostKeys.Callback(bastionID, hop.Name),
+				HostKeyAlgorithms: HostKeys.Algorithms(bastionID),
+			},
+		})
+	}
+	return hops
+}
+
+// Run dispatches JOB to a worker.  It returns false without dispatching
+// JOB if the session is cancelled.
+func (s *SshSession) Run(job *SshJob) bool {
+	// select picks a random case if a worker is also ready
+	if s.Cancelled() {
+		return false
+	}
+	select {
+	case s.input <- job:
+		return true
+	case <-s.cancel:
+		return false
+	}
+}
+
+// Cancel stops dispatching new jobs, and sends SIG to the running
+// commands.  The connections of the jobs that do not finish in
+// CANCEL_GRACE_PERIOD are closed.
+func (s *SshSession) Cancel(sig ssh.Signal) {
+	s.cancelOnce.Do(func() {
+		s.signal = sig
+		close(s.cancel)
+	})
+}
+
+// Done returns the channel that is closed on Cancel().
+func (s *SshSession) Done() <-chan struct{} {
+	return s.cancel
+}
+
+func (s *SshSession) Cancelled() bool {
+	select {
+	case <-s.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruptOnCancel waits until the session is cancelled or DONE is
+// closed.  On cancel, it calls INTERRUPT if not nil, and closes CLIENT if
+// the job does not finish in the grace period.
+func (s *SshSession) interruptOnCancel(done chan struct{}, client *ssh.Client, interrupt func(), wid int) {
+	select {
+	case <-done:
+		return
+	case <-s.cancel:
+	}
+
+	if interrupt != nil {
+		interrupt()
+	}
+	select {
+	case <-done:
+	case <-time.After(CANCEL_GRACE_PERIOD):
+		l.Debug("SshWorker[%d]: closing the connection after the grace period", wid)
+		client.Close()
+	}
 }
 
 func (s *SshSession) Close() {
 	close(s.input)
 	s.workerGroup.Wait()
+	s.bastions.Close()
 }
 
 func (s *SshSession) worker(wid int) {
@@ -162,58 +288,202 @@ func (s *SshSession) worker(wid int) {
 	l.Trace("SshWorker[%d] finished", wid)
 }
 
-func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
-	var client *ssh.Client
-	var err error
+// connect creates ssh.Client for the server of JOB, through the bastions if
+// JOB requires it.  The returned function closes the client as well as the
+// bastion connection.
+func (s *SshSession) connect(job *SshJob, wid int) (*ssh.Client, func(), error) {
+	if len(job.Bastions) == 0 {
+		l.Debug("SshWorker[%d].connect: creating ssh.Client for server[%v] %s", wid, job.InstanceName, job.Server)
 
-	if job.Input != nil {
-		defer job.Input.Close()
+		client, err := s.sshClient(job.Server, job.ServerConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.keepalive(client)
+		return client, func() { client.Close() }, nil
 	}
 
-	if job.DryRun {
-		return SshResult{Status: nil,
-			Time:   time.Now(),
-			Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+	chain := BastionChain(job.Bastions)
+	l.Debug("SshWorker[%d].connect: acquiring ssh.Client for bastion %s", wid, chain)
+	bastion, conn, err := s.bastions.Connect(job.Bastions, job.Server)
+	if err != nil {
+		return nil, nil, err // fmt.Errorf("ssh.Client.Dial() failed: %s\n", err)
 	}
 
-	if job.BastionConfig != nil {
-		l.Debug("SshWorker[%d].doSSH: creating ssh.Client for bastion %s", wid, job.Bastion)
-		client, err = s.sshClient(job.Bastion, job.BastionConfig)
-		if err != nil {
-			return SshResult{Status: err,
-				Time:   time.Now(),
-				Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+	client, err := newClientConn(conn, job.Server, job.ServerConfig)
+	if err != nil {
+		s.bastions.Release(bastion)
+		return nil, nil, err
+	}
+	l.Debug("SshWorker[%d].connect: creating ssh.Client for server[%v] %s through bastion %s", wid, job.InstanceName, job.Server, chain)
+	s.keepalive(client)
+
+	return client, func() {
+		client.Close()
+		s.bastions.Release(bastion)
+	}, nil
+}
+
+// connectRetry calls connect() until it succeeds, up to the configured
+// number of retries.  The delay between the attempts starts from the
+// configured backoff, and doubles for each retry.  A host key mismatch is
+// never retried.  It returns the number of the attempts as well.
+func (s *SshSession) connectRetry(job *SshJob, wid int) (*ssh.Client, func(), int, error) {
+	backoff := s.config.RetryBackoff
+	var hkerr *HostKeyError
+
+	var derr *DecryptError
+
+	for attempt := 1; ; attempt++ {
+		client, closer, err := s.connect(job, wid)
+		if errors.As(err, &derr) {
+			// the key is skipped by AuthMethods.Signers() from now on, so
+			// try again at once without it
+			l.Debug("SshWorker[%d].connectRetry: skipping the key %s for server[%v]", wid, derr.Filename, job.InstanceName)
+			attempt--
+			continue
 		}
+		if err == nil || attempt > s.config.Retries || errors.As(err, &hkerr) {
+			return client, closer, attempt, err
+		}
+
+		l.Debug("SshWorker[%d].connectRetry: attempt %d to server[%v] failed: %v; retrying in %v", wid, attempt, job.InstanceName, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.cancel:
+			return nil, nil, attempt, err
+		}
+		backoff *= 2
+	}
+}
 
-		conn, err := client.Dial("tcp", job.Server)
+// dialBastions connects to the last one of HOPS, through the earlier hops.
+// Closing the returned client closes the connections to the earlier hops.
+func (s *SshSession) dialBastions(hops []SshHop) (*ssh.Client, error) {
+	client, err := s.sshClient(hops[0].Address, hops[0].Config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hop := range hops[1:] {
+		conn, err := client.Dial("tcp", hop.Address)
 		if err != nil {
 			client.Close()
-			return SshResult{Status: err, // fmt.Errorf("ssh.Client.Dial() failed: %s\n", err),
-				Time:   time.Now(),
-				Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+			return nil, err
 		}
-
-		nc, chans, reqs, err := ssh.NewClientConn(conn, job.Server, job.ServerConfig)
+		next, err := newClientConn(conn, hop.Address, hop.Config)
 		if err != nil {
-			conn.Close()
 			client.Close()
-			return SshResult{Status: err, // fmt.Errorf("error: ssh.NewClientConn() failed: %s", err),
-				Time:   time.Now(),
-				Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+			return nil, err
 		}
-		l.Debug("SshWorker[%d].doSSH: creating ssh.Client for server[%v] %s through bastion %s", wid, job.InstanceName, job.Server, job.Bastion)
-		client = ssh.NewClient(nc, chans, reqs)
+
+		go func(prev *ssh.Client) {
+			next.Wait()
+			prev.Close()
+		}(client)
+		client = next
+	}
+	s.keepalive(client)
+	return client, nil
+}
+
+// keepalive starts sending the keepalive requests to CLIENT, if enabled.
+func (s *SshSession) keepalive(client *ssh.Client) {
+	if s.config.KeepaliveInterval > 0 {
+		go keepalive(client, s.config.KeepaliveInterval)
+	}
+}
+
+// newClientConn creates ssh.Client for ADDR over CONN, which is usually
+// tunneled through a bastion.  CONN is closed on failure.
+func newClientConn(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err // fmt.Errorf("error: ssh.NewClientConn() failed: %s", err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
+	if job.Input != nil {
+		defer job.Input.Close()
+	}
+
+	if job.DryRun {
+		return SshResult{Status: nil,
+			Time:   time.Now(),
+			Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+	}
+
+	start := time.Now()
+	bastion := BastionChain(job.Bastions)
+
+	client, closeClient, attempts, err := s.connectRetry(job, wid)
+	if err != nil {
+		return SshResult{Status: err,
+			Start:    start,
+			Time:     time.Now(),
+			Attempts: attempts,
+			Class:    ClassifyStatus(err, false, job.Transfer != nil, false),
+			Bastion:  bastion,
+			Server:   job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+	}
+	defer closeClient()
+
+	var result SshResult
+	var watchdog *Watchdog
+	if job.Transfer != nil {
+		// the idle timeout is not applied to the transfers
+		watchdog = NewWatchdog(s.config.CommandTimeout, 0)
+		watchdog.Start(client, nil, wid)
+
+		done := make(chan struct{})
+		go s.interruptOnCancel(done, client, nil, wid)
+		result = s.doTransfer(client, job, wid)
+		close(done)
+		watchdog.Stop()
 	} else {
-		l.Debug("SshWorker[%d].doSSH: creating ssh.Client for server[%v] %s", wid, job.InstanceName, job.Server)
+		watchdog = NewWatchdog(s.config.CommandTimeout, s.config.IdleTimeout)
+		result = s.runCommand(client, job, watchdog, wid)
+	}
+	result.Start = start
+	result.Attempts = attempts
+	result.Bastion = bastion
 
-		client, err = s.sshClient(job.Server, job.ServerConfig)
+	if result.Status != nil && s.Cancelled() {
+		result.Class = RESULT_INTERRUPTED
+	} else {
+		result.Class = ClassifyStatus(result.Status, true, job.Transfer != nil, watchdog.Expired())
+	}
+	return result
+}
+
+// captureOutput returns true if the outputs of the commands should be kept
+// in SshResult.
+func (s *SshSession) captureOutput() bool {
+	if s.config.OutputFormat != FORMAT_TEXT {
+		return s.config.OutDirectory == "" && s.config.ErrDirectory == ""
+	}
+	return s.config.InlineOutput || s.config.GroupOutput
+}
+
+// runCommand runs the command of JOB in a new session of CLIENT.  The
+// activities of the standard input and outputs are reported to WATCHDOG.
+func (s *SshSession) runCommand(client *ssh.Client, job *SshJob, watchdog *Watchdog, wid int) SshResult {
+	words := job.Command
+	if job.Script != nil {
+		dir, err := s.uploadScript(client, job.Script)
 		if err != nil {
 			return SshResult{Status: err,
 				Time:   time.Now(),
 				Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
 		}
+		// also removed by the wrapper of the command, if the connection
+		// is closed before this
+		defer s.removeScript(client, dir)
+		words = job.Script.Command(dir, job.Command)
 	}
-	defer client.Close() // TODO: should I Close() twice for the bastion path?
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -223,14 +493,26 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 	}
 
 	defer session.Close()
-	if job.Pty != nil {
-		l.Debug("SshWorker[%d].doSSH: allocating Pty: %v", wid, job.Pty)
+
+	pty := job.Pty
+	if s.config.Sudo && pty == nil && job.Input == nil && !s.config.InlineStdoutOnly &&
+		s.config.OutputFormat == FORMAT_TEXT && s.config.ErrDirectory == "" {
+		// for "Defaults requiretty" in sudoers(5).  Not used if the
+		// input is given or the standard error is separated (by
+		// --inline-stdout, --format or -e), since the PTY changes them.
+		pty = &RequestPty{Term: "dumb", Width: 80, Height: 24}
+	}
+	if pty != nil {
+		l.Debug("SshWorker[%d].doSSH: allocating Pty: %v", wid, pty)
 		modes := ssh.TerminalModes{
 			ssh.ECHO:          0,
 			ssh.TTY_OP_ISPEED: 14400,
 			ssh.TTY_OP_OSPEED: 14400,
 		}
-		if err := session.RequestPty(job.Pty.Term, job.Pty.Height, job.Pty.Width, modes); err != nil {
+		if s.config.Sudo {
+			modes[ssh.ONLCR] = 0
+		}
+		if err := session.RequestPty(pty.Term, pty.Height, pty.Width, modes); err != nil {
 			return SshResult{Status: fmt.Errorf("ssh.Session.RequestPty() failed: %s", err),
 				Time:   time.Now(),
 				Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
@@ -257,8 +539,15 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 		wg.Add(1)
 	}
 
+	stdout = watchdog.Reader(stdout)
+	stderr = watchdog.Reader(stderr)
+
 	var stdin io.WriteCloser
+	var input io.Reader
 	if job.Input != nil {
+		input = watchdog.Reader(job.Input)
+	}
+	if job.Input != nil || s.config.Sudo {
 		l.Debug("creating STDIN pipe, %v", job.Input)
 		stdin, err = session.StdinPipe()
 		if err != nil {
@@ -270,19 +559,24 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 		}
 	}
 
-	result := SshResult{Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+	var sudo *SudoResponder
+	if s.config.Sudo {
+		sudo = NewSudoResponder(stdin, pty != nil, SudoPassword)
+		stdout = sudo.Reader(stdout)
+		stderr = sudo.Reader(stderr)
+		input = sudo.Input(input)
+	}
 
-	if s.config.InlineOutput { // inline
-		var stdoutBuffer bytes.Buffer
-		var stderrBuffer bytes.Buffer
+	result := SshResult{Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
 
-		result.Stdout = &stdoutBuffer
-		result.Stderr = &stderrBuffer
+	if s.captureOutput() { // inline
+		result.Stdout = NewSpool(s.config.MaxOutput)
+		result.Stderr = NewSpool(s.config.MaxOutput)
 
 		go func() {
 			defer wg.Done()
 			//io.Copy(os.Stdout, stdout)
-			n, err := stdoutBuffer.ReadFrom(stdout)
+			n, err := io.Copy(result.Stdout, stdout)
 			l.Debug("SshWorker[%d].doSSH: copying stdout: %d bytes, err = %v", wid, n, err)
 
 		}()
@@ -290,7 +584,7 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 			defer wg.Done()
 			//io.Copy(os.Stdout, stderr)
 
-			n, err := stderrBuffer.ReadFrom(stderr)
+			n, err := io.Copy(result.Stderr, stderr)
 			l.Debug("SshWorker[%d].doSSH: copying stderr: %d bytes, err = %v", wid, n, err)
 		}()
 		if stdin != nil {
@@ -299,7 +593,33 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 				defer stdin.Close()
 				//io.Copy(os.Stdout, stderr)
 
-				nwritten, err := io.Copy(stdin, job.Input)
+				nwritten, err := io.Copy(stdin, input)
+
+				l.Debug("SshWorker[%d].doSSH: copying stdin: %d bytes, err = %v", wid, nwritten, err)
+			}()
+		}
+	} else if s.stream != nil { // streaming
+		outw := s.stream.Writer(os.Stdout, job.InstanceName)
+		errw := s.stream.Writer(os.Stderr, job.InstanceName)
+
+		go func() {
+			defer wg.Done()
+			defer outw.Close()
+			n, err := io.Copy(outw, stdout)
+			l.Debug("SshWorker[%d].doSSH: streaming stdout: %d bytes, err = %v", wid, n, err)
+		}()
+		go func() {
+			defer wg.Done()
+			defer errw.Close()
+			n, err := io.Copy(errw, stderr)
+			l.Debug("SshWorker[%d].doSSH: streaming stderr: %d bytes, err = %v", wid, n, err)
+		}()
+		if stdin != nil {
+			go func() {
+				defer wg.Done()
+				defer stdin.Close()
+
+				nwritten, err := io.Copy(stdin, input)
 
 				l.Debug("SshWorker[%d].doSSH: copying stdin: %d bytes, err = %v", wid, nwritten, err)
 			}()
@@ -311,7 +631,7 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 				defer stdin.Close()
 				//io.Copy(os.Stdout, stderr)
 
-				nwritten, err := io.Copy(stdin, job.Input)
+				nwritten, err := io.Copy(stdin, input)
 
 				l.Debug("SshWorker[%d].doSSH: copying stdin: %d bytes, err = %v", wid, nwritten, err)
 			}()
@@ -325,9 +645,11 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 					Time:   time.Now(),
 					Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
 			}
+			result.StdoutFile = outname
 
 			go func() {
 				defer wg.Done()
+				defer out.Close()
 				n, err := io.Copy(out, stdout)
 				l.Debug("SshWorker[%d].doSSH: copying stdout: %d bytes, err = %v", wid, n, err)
 			}()
@@ -347,9 +669,11 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 					Time:   time.Now(),
 					Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
 			}
+			result.StderrFile = outname
 
 			go func() {
 				defer wg.Done()
+				defer out.Close()
 				n, err := io.Copy(out, stderr)
 				l.Debug("SshWorker[%d].doSSH: copying stderr: %d bytes, err = %v", wid, n, err)
 			}()
@@ -362,30 +686,118 @@ func (s *SshSession) doSSH(job *SshJob, wid int) SshResult {
 		}
 	}
 
-	command := shellquote.Join(job.Command...)
-	if !s.config.InlineStdoutOnly {
+	command := shellquote.Join(words...)
+	if sudo != nil {
+		// sudo resets the environment, so the variables are exported by
+		// the command
+		command = SudoCommand(exportPreamble(s.config.Env)+command, s.config.SudoUser)
+	}
+	if !s.config.InlineStdoutOnly && s.config.OutputFormat == FORMAT_TEXT {
 		command = fmt.Sprintf("exec 2>&1; %s", command)
 	}
+	if sudo == nil {
+		command = applyEnv(session, s.config.Env) + command
+	}
+
+	done := make(chan struct{})
+	go s.interruptOnCancel(done, client, func() {
+		l.Debug("SshWorker[%d].doSSH: sending %s to server[%v]", wid, s.signal, job.InstanceName)
+		session.Signal(s.signal)
+	}, wid)
+	watchdog.Start(client, func() {
+		l.Debug("SshWorker[%d].doSSH: sending %s to server[%v] on timeout", wid, ssh.SIGTERM, job.InstanceName)
+		session.Signal(ssh.SIGTERM)
+	}, wid)
 
 	l.Debug("SshWorker[%d].doSSH: executing a command: %s", wid, command)
 	err = session.Run(command)
 	l.Debug("SshWorker[%d].doSSH: command result(err): %v", wid, err)
 	result.Time = time.Now()
 	result.Status = err
+	close(done)
+	watchdog.Stop()
+	if sudo != nil {
+		sudo.Close()
+		if serr := sudo.Err(); serr != nil && err != nil {
+			result.Status = fmt.Errorf("%s: %w", serr, err)
+		}
+	}
 
 	wg.Wait()
 
+	if err != nil && s.Cancelled() {
+		// the output files of the interrupted commands are incomplete
+		if result.StdoutFile != "" && os.Rename(result.StdoutFile, result.StdoutFile+".partial") == nil {
+			result.StdoutFile += ".partial"
+		}
+		if result.StderrFile != "" && os.Rename(result.StderrFile, result.StderrFile+".partial") == nil {
+			result.StderrFile += ".partial"
+		}
+	}
+
 	return result
 }
 
-func PrintScpConf(out *bytes.Buffer, bastion string, bastionPort string, bastionUser string, host string, hostPort string, hostUser string, command []string) error {
-	// the output should be the bash array literal, (".." "..." ...)
-	var bEndpoint, hEndpoint string
-	if bastionUser == "" {
-		bEndpoint = fmt.Sprintf("%s", bastion)
-	} else {
-		bEndpoint = fmt.Sprintf("%s@%s", bastionUser, bastion)
+// ProxyHop is a bastion server in the command-line print modes.
+type ProxyHop struct {
+	User string
+	Host string
+	Port string
+}
+
+func (hop ProxyHop) endpoint() string {
+	if hop.User == "" {
+		return hop.Host
+	}
+	return fmt.Sprintf("%s@%s", hop.User, hop.Host)
+}
+
+// proxyCommandOptions returns ssh(1) options for the ProxyCommand through
+// BASTIONS, which runs "triton-pssh proxy" with ProxyOptions so that the
+// bastions do not need nc(1).  The options are not quoted; the command in
+// the option is quoted for the shell that ssh(1) runs it with.
+func proxyCommandOptions(bastions []ProxyHop) []string {
+	if len(bastions) == 0 {
+		return nil
+	}
+
+	hops := []string{}
+	for _, hop := range bastions {
+		hops = append(hops, fmt.Sprintf("%s:%s", hop.endpoint(), hop.Port))
 	}
+	words := append([]string{ProxyProgram, "proxy", "-b", strings.Join(hops, ",")}, ProxyOptions...)
+	command := shellquote.Join(words...)
+	// ssh(1) expands '%' in ProxyCommand
+	command = strings.Replace(command, "%", "%%", -1)
+	return []string{"-o", fmt.Sprintf("ProxyCommand=%s %%h %%p", command)}
+}
+
+// writeProxyCommand writes ssh(1) option for the ProxyCommand through
+// BASTIONS, quoted for the shell.
+func writeProxyCommand(out *bytes.Buffer, bastions []ProxyHop) {
+	if options := proxyCommandOptions(bastions); len(options) > 0 {
+		out.WriteString(shellquote.Join(options...) + " ")
+	}
+}
+
+// rsyncJoin joins WORDS into the remote shell command of rsync(1) -e, which
+// splits the command by itself; a word may be quoted by '"', and '""' in
+// it is a literal '"'.
+func rsyncJoin(words []string) string {
+	var quoted []string
+	for _, word := range words {
+		if word != "" && !strings.ContainsAny(word, " \t\"'") {
+			quoted = append(quoted, word)
+			continue
+		}
+		quoted = append(quoted, "\""+strings.Replace(word, "\"", "\"\"", -1)+"\"")
+	}
+	return strings.Join(quoted, " ")
+}
+
+func PrintScpConf(out *bytes.Buffer, bastions []ProxyHop, host string, hostPort string, hostUser string, command []string) error {
+	// the output should be the bash array literal, (".." "..." ...)
+	var hEndpoint string
 	if hostUser == "" {
 		hEndpoint = fmt.Sprintf("%s", host)
 	} else {
@@ -396,9 +808,7 @@ func PrintScpConf(out *bytes.Buffer, bastion string, bastionPort string, bastion
 	out.WriteString("scp ")
 	out.WriteString("-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null ")
 
-	if bastion != "" {
-		out.WriteString(fmt.Sprintf("-o \"ProxyCommand=ssh -p %s -q %s nc %%h %%p\" ", bastionPort, bEndpoint))
-	}
+	writeProxyCommand(out, bastions)
 
 	out.WriteString(fmt.Sprintf("-P %s ", hostPort))
 
@@ -412,14 +822,9 @@ func PrintScpConf(out *bytes.Buffer, bastion string, bastionPort string, bastion
 	return nil
 }
 
-func PrintRsyncConf(out *bytes.Buffer, bastion string, bastionPort string, bastionUser string, host string, hostPort string, hostUser string, command []string) error {
+func PrintRsyncConf(out *bytes.Buffer, bastions []ProxyHop, host string, hostPort string, hostUser string, command []string) error {
 	// the output should be the bash array literal, (".." "..." ...)
-	var bEndpoint, hEndpoint string
-	if bastionUser == "" {
-		bEndpoint = fmt.Sprintf("%s", bastion)
-	} else {
-		bEndpoint = fmt.Sprintf("%s@%s", bastionUser, bastion)
-	}
+	var hEndpoint string
 	if hostUser == "" {
 		hEndpoint = fmt.Sprintf("%s", host)
 	} else {
@@ -428,12 +833,11 @@ func PrintRsyncConf(out *bytes.Buffer, bastion string, bastionPort string, basti
 
 	out.WriteString("(")
 	out.WriteString("rsync ")
-	out.WriteString("-e 'ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null ")
 
-	if bastion != "" {
-		out.WriteString(fmt.Sprintf("-o \"ProxyCommand=ssh -p %s -q %s nc %%h %%p\" ", bastionPort, bEndpoint))
-	}
-	out.WriteString(fmt.Sprintf("-p %s' ", hostPort))
+	rsh := []string{"ssh", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null"}
+	rsh = append(rsh, proxyCommandOptions(bastions)...)
+	rsh = append(rsh, "-p", hostPort)
+	out.WriteString(fmt.Sprintf("-e %s ", shellquote.Join(rsyncJoin(rsh))))
 
 	replaced, err := ExpandPlaceholder(command, hEndpoint)
 	if err != nil {
@@ -445,14 +849,9 @@ func PrintRsyncConf(out *bytes.Buffer, bastion string, bastionPort string, basti
 	return nil
 }
 
-func PrintSshConf(out *bytes.Buffer, bastion string, bastionPort string, bastionUser string, host string, hostPort string, hostUser string, command []string) error {
+func PrintSshConf(out *bytes.Buffer, bastions []ProxyHop, host string, hostPort string, hostUser string, command []string) error {
 	// the output should be the bash array literal, (".." "..." ...)
-	var bEndpoint, hEndpoint string
-	if bastionUser == "" {
-		bEndpoint = fmt.Sprintf("%s", bastion)
-	} else {
-		bEndpoint = fmt.Sprintf("%s@%s", bastionUser, bastion)
-	}
+	var hEndpoint string
 	if hostUser == "" {
 		hEndpoint = fmt.Sprintf("%s", host)
 	} else {
@@ -468,9 +867,7 @@ func PrintSshConf(out *bytes.Buffer, bastion string, bastionPort string, bastion
 
 	out.WriteString("-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null ")
 
-	if bastion != "" {
-		out.WriteString(fmt.Sprintf("-o \"ProxyCommand=ssh -p %s -q %s nc %%h %%p\" ", bastionPort, bEndpoint))
-	}
+	writeProxyCommand(out, bastions)
 
 	out.WriteString(fmt.Sprintf("-p %s ", hostPort))
 
@@ -500,17 +897,15 @@ func (s *SshSession) PrintConf(job *SshJob, mode PrintConfMode) error {
 
 	buf.WriteString("cmdline=")
 
-	var bastionHost, bastionPort, bastionUser, host, port, user string
+	var bastions []ProxyHop
+	var host, port, user string
 
-	if job.BastionConfig != nil {
-		toks := strings.Split(job.Bastion, ":")
+	for _, hop := range job.Bastions {
+		toks := strings.Split(hop.Address, ":")
 		if len(toks) != 2 {
-			return fmt.Errorf("cannot get host:port from %s", job.Bastion)
+			return fmt.Errorf("cannot get host:port from %s", hop.Address)
 		}
-
-		bastionHost = toks[0]
-		bastionPort = toks[1]
-		bastionUser = job.BastionConfig.User
+		bastions = append(bastions, ProxyHop{User: hop.Config.User, Host: toks[0], Port: toks[1]})
 	}
 	toks := strings.Split(job.Server, ":")
 	if len(toks) != 2 {
@@ -523,11 +918,11 @@ func (s *SshSession) PrintConf(job *SshJob, mode PrintConfMode) error {
 	var err error
 	switch mode {
 	case MODE_RSYNC:
-		err = PrintRsyncConf(&buf, bastionHost, bastionPort, bastionUser, host, port, user, job.Command)
+		err = PrintRsyncConf(&buf, bastions, host, port, user, job.Command)
 	case MODE_SCP:
-		err = PrintScpConf(&buf, bastionHost, bastionPort, bastionUser, host, port, user, job.Command)
+		err = PrintScpConf(&buf, bastions, host, port, user, job.Command)
 	case MODE_SSH:
-		err = PrintSshConf(&buf, bastionHost, bastionPort, bastionUser, host, port, user, job.Command)
+		err = PrintSshConf(&buf, bastions, host, port, user, job.Command)
 	default:
 		panic(fmt.Sprintf("unsupported mode=%s", mode))
 	}
@@ -544,23 +939,21 @@ func (s *SshSession) PrintConf(job *SshJob, mode PrintConfMode) error {
 }
 
 func (s *SshSession) sshClient(endpoint string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	// dialer := net.Dialer{Timeout: config.Timeout, Deadline: time.Now().Add(Config.Deadline)}
 	dialer := net.Dialer{Timeout: config.Timeout}
-	if s.config.Deadline > 0 {
-		dialer.Deadline = time.Now().Add(s.config.Deadline)
-	}
 
 	conn, err := dialer.Dial("tcp", endpoint)
 	if err != nil {
 		return nil, err // fmt.Errorf("error: Dial() failed: %s", err)
 	}
 
-	if s.config.Deadline > 0 {
-		conn.SetDeadline(time.Now().Add(s.config.Deadline))
-	}
-
+	// Only the handshake is limited by the connection timeout.  The
+	// established connection is checked by the keepalives, and the
+	// commands are limited by the watchdog.
+	startHandshake(conn, config.Timeout)
 	c, chans, reqs, err := ssh.NewClientConn(conn, endpoint, config)
+	endHandshake(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err // fmt.Errorf("error: ssh.NewClientConn() failed: %s", err)
 	}
 
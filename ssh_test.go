@@ -3,9 +3,14 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	shellquote "github.com/kballard/go-shellquote"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -68,10 +73,23 @@ func Test_SshSession_workers(env *testing.T) {
 	s.Close()
 }
 
+func Test_SshSession_RunAfterCancel(env *testing.T) {
+	s := NewSshSession(&TsshConfig{}, 4)
+	defer s.Close()
+	s.Cancel(ssh.SIGINT)
+
+	for i := 0; i < 100; i++ {
+		job := SshJob{DryRun: true, ServerConfig: &ssh.ClientConfig{}, Result: make(chan SshResult, 1)}
+		if s.Run(&job) {
+			env.Fatalf("job %d started after Cancel()", i)
+		}
+	}
+}
+
 func TestSsh_PrintScpConf_WithoutBastion(env *testing.T) {
 	out := bytes.Buffer{}
 
-	err := PrintScpConf(&out, "", "", "", "HOST", "PORT", "USER", []string{"-SCP_OPT", "SCP ARG", "{}:THE DIR"})
+	err := PrintScpConf(&out, nil, "HOST", "PORT", "USER", []string{"-SCP_OPT", "SCP ARG", "{}:THE DIR"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
@@ -86,12 +104,28 @@ func TestSsh_PrintScpConf_WithoutBastion(env *testing.T) {
 func TestSsh_PrintScpConf_WithBastion(env *testing.T) {
 	out := bytes.Buffer{}
 
-	err := PrintScpConf(&out, "BHOST", "BPORT", "BUSER", "HOST", "PORT", "USER", []string{"-SCP_OPT", "SCP ARG", "{}:THE DIR"})
+	err := PrintScpConf(&out, []ProxyHop{{"BUSER", "BHOST", "BPORT"}}, "HOST", "PORT", "USER", []string{"-SCP_OPT", "SCP ARG", "{}:THE DIR"})
+	if err != nil {
+		env.Errorf("unexpected error: %v", err)
+	}
+
+	expected := `(scp -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o 'ProxyCommand=triton-pssh proxy -b BUSER@BHOST:BPORT %h %p' -P PORT -SCP_OPT 'SCP ARG' 'USER@HOST:THE DIR')`
+
+	if out.String() != expected {
+		env.Errorf("expected |%v|, got |%v|", expected, out.String())
+	}
+}
+
+func TestSsh_PrintScpConf_WithBastionChain(env *testing.T) {
+	out := bytes.Buffer{}
+
+	bastions := []ProxyHop{{"GUSER", "GATEWAY", "2222"}, {"", "BHOST1", "22"}, {"BUSER", "BHOST", "BPORT"}}
+	err := PrintScpConf(&out, bastions, "HOST", "PORT", "USER", []string{"{}:THE DIR"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
 
-	expected := `(scp -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "ProxyCommand=ssh -p BPORT -q BUSER@BHOST nc %h %p" -P PORT -SCP_OPT 'SCP ARG' 'USER@HOST:THE DIR')`
+	expected := `(scp -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o 'ProxyCommand=triton-pssh proxy -b GUSER@GATEWAY:2222,BHOST1:22,BUSER@BHOST:BPORT %h %p' -P PORT 'USER@HOST:THE DIR')`
 
 	if out.String() != expected {
 		env.Errorf("expected |%v|, got |%v|", expected, out.String())
@@ -102,7 +136,7 @@ func TestSsh_PrintRsyncConf_WithoutBastion(env *testing.T) {
 	os.Setenv("SSH_AUTH_SOCK", "TEST")
 	out := bytes.Buffer{}
 
-	err := PrintRsyncConf(&out, "", "", "", "HOST", "PORT", "USER", []string{"-RSYNC_OPT", "RSYNC ARG", "{}:THE DIR"})
+	err := PrintRsyncConf(&out, nil, "HOST", "PORT", "USER", []string{"-RSYNC_OPT", "RSYNC ARG", "{}:THE DIR"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
@@ -118,23 +152,152 @@ func TestSsh_PrintRsyncConf_WithBastion(env *testing.T) {
 	os.Setenv("SSH_AUTH_SOCK", "TEST")
 	out := bytes.Buffer{}
 
-	err := PrintRsyncConf(&out, "BHOST", "BPORT", "BUSER", "HOST", "PORT", "USER", []string{"-RSYNC_OPT", "RSYNC ARG", "{}:THE DIR"})
+	err := PrintRsyncConf(&out, []ProxyHop{{"BUSER", "BHOST", "BPORT"}}, "HOST", "PORT", "USER", []string{"-RSYNC_OPT", "RSYNC ARG", "{}:THE DIR"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
 
-	expected := `(rsync -e 'ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "ProxyCommand=ssh -p BPORT -q BUSER@BHOST nc %h %p" -p PORT' -RSYNC_OPT 'RSYNC ARG' 'USER@HOST:THE DIR')`
+	expected := `(rsync -e 'ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "ProxyCommand=triton-pssh proxy -b BUSER@BHOST:BPORT %h %p" -p PORT' -RSYNC_OPT 'RSYNC ARG' 'USER@HOST:THE DIR')`
 
 	if out.String() != expected {
 		env.Errorf("expected |%v|, got |%v|", expected, out.String())
 	}
 }
 
+// rsyncSplit splits the remote shell command of rsync -e as rsync does.
+func rsyncSplit(command string) []string {
+	var words []string
+	var word []byte
+	var quote byte
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote != 0 && c == quote && i+1 < len(command) && command[i+1] == quote:
+			word = append(word, c)
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote, inWord = c, true
+		case quote == 0 && c == ' ':
+			if inWord {
+				words = append(words, string(word))
+			}
+			word, inWord = nil, false
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func TestSsh_PrintConf_ProxyProgramQuoting(env *testing.T) {
+	saved := ProxyProgram
+	defer func() { ProxyProgram = saved }()
+	ProxyProgram = `/opt/my tools/it's "triton-pssh" 100%`
+
+	bastions := []ProxyHop{{"BUSER", "BHOST", "BPORT"}}
+	expected := []string{ProxyProgram, "proxy", "-b", "BUSER@BHOST:BPORT", "%h", "%p"}
+
+	// proxyCommand checks the ProxyCommand option in WORDS, as ssh(1) runs it
+	proxyCommand := func(mode string, words []string) {
+		for _, word := range words {
+			if !strings.HasPrefix(word, "ProxyCommand=") {
+				continue
+			}
+			command := strings.Replace(strings.TrimPrefix(word, "ProxyCommand="), "%%", "%", -1)
+			got, err := shellquote.Split(command)
+			if err != nil || !reflect.DeepEqual(got, expected) {
+				env.Errorf("%s: expected %q, got %q (%v)", mode, expected, got, err)
+			}
+			return
+		}
+		env.Errorf("%s: no ProxyCommand in %q", mode, words)
+	}
+
+	// the contents of the bash array literal, (...)
+	array := func(out bytes.Buffer) []string {
+		words, err := shellquote.Split(strings.TrimSuffix(strings.TrimPrefix(out.String(), "("), ")"))
+		if err != nil {
+			env.Fatalf("cannot parse |%s|: %v", out.String(), err)
+		}
+		return words
+	}
+
+	out := bytes.Buffer{}
+	if err := PrintScpConf(&out, bastions, "HOST", "PORT", "USER", []string{"{}:DIR"}); err != nil {
+		env.Fatal(err)
+	}
+	proxyCommand("scp", array(out))
+
+	out.Reset()
+	if err := PrintRsyncConf(&out, bastions, "HOST", "PORT", "USER", []string{"{}:DIR"}); err != nil {
+		env.Fatal(err)
+	}
+	words := array(out)
+	if len(words) < 3 || words[1] != "-e" {
+		env.Fatalf("rsync: no -e option in %q", words)
+	}
+	proxyCommand("rsync", rsyncSplit(words[2]))
+}
+
+func TestSsh_PrintConf_ProxyOptions(env *testing.T) {
+	saved := ProxyOptions
+	defer func() { ProxyOptions = saved }()
+	ProxyOptions = nil
+
+	options := []Option{
+		{'A', "agent", ""},
+		{'I', "identity", "/home/me/my keys/id_50%"},
+		{0, "certificate", "/home/me/id-cert.pub"},
+		{0, "password-file", "/home/me/passwords"},
+		{'T', "timeout", "3"},
+		{0, "keepalive", "5"},
+		{0, "host-key-check", "strict"},
+		{0, "repin", ""},
+		{'p', "parallel", "8"},
+		{'u', "user", "admin"},
+	}
+	for i := range options {
+		AddProxyOption(&options[i], options[i].Argument)
+	}
+
+	out := bytes.Buffer{}
+	if err := PrintSshConf(&out, []ProxyHop{{"BUSER", "BHOST", "BPORT"}}, "HOST", "PORT", "USER", nil); err != nil {
+		env.Fatal(err)
+	}
+	words, err := shellquote.Split(strings.TrimSuffix(strings.TrimPrefix(out.String(), "("), ")"))
+	if err != nil {
+		env.Fatalf("cannot parse |%s|: %v", out.String(), err)
+	}
+
+	expected := []string{ProxyProgram, "proxy", "-b", "BUSER@BHOST:BPORT",
+		"--agent", "--identity=/home/me/my keys/id_50%", "--certificate=/home/me/id-cert.pub",
+		"--password-file=/home/me/passwords", "--timeout=3", "--keepalive=5",
+		"--host-key-check=strict", "--repin", "%h", "%p"}
+	for _, word := range words {
+		if !strings.HasPrefix(word, "ProxyCommand=") {
+			continue
+		}
+		command := strings.Replace(strings.TrimPrefix(word, "ProxyCommand="), "%%", "%", -1)
+		got, err := shellquote.Split(command)
+		if err != nil || !reflect.DeepEqual(got, expected) {
+			env.Errorf("expected %q, got %q (%v)", expected, got, err)
+		}
+		return
+	}
+	env.Errorf("no ProxyCommand in %q", words)
+}
+
 func TestSsh_PrintSshConf_WithoutBastion(env *testing.T) {
 	os.Setenv("SSH_AUTH_SOCK", "TEST")
 	out := bytes.Buffer{}
 
-	err := PrintSshConf(&out, "", "", "", "HOST", "PORT", "USER", []string{"-M", "-v"})
+	err := PrintSshConf(&out, nil, "HOST", "PORT", "USER", []string{"-M", "-v"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
@@ -150,14 +313,69 @@ func TestSsh_PrintSshConf_WithBastion(env *testing.T) {
 	os.Setenv("SSH_AUTH_SOCK", "TEST")
 	out := bytes.Buffer{}
 
-	err := PrintSshConf(&out, "BHOST", "BPORT", "BUSER", "HOST", "PORT", "USER", []string{"-M", "-v"})
+	err := PrintSshConf(&out, []ProxyHop{{"BUSER", "BHOST", "BPORT"}}, "HOST", "PORT", "USER", []string{"-M", "-v"})
 	if err != nil {
 		env.Errorf("unexpected error: %v", err)
 	}
 
-	expected := `(ssh -A -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "ProxyCommand=ssh -p BPORT -q BUSER@BHOST nc %h %p" -p PORT -M -v "USER@HOST")`
+	expected := `(ssh -A -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o 'ProxyCommand=triton-pssh proxy -b BUSER@BHOST:BPORT %h %p' -p PORT -M -v "USER@HOST")`
 
 	if out.String() != expected {
 		env.Errorf("expected |%v|, got |%v|", expected, out.String())
 	}
 }
+
+func TestSsh_ConnectRetry(env *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close() // nobody listens on ADDR now
+
+	config := TsshConfig{Retries: 2, RetryBackoff: time.Duration(1) * time.Millisecond}
+	s := NewSshSession(&config, 0)
+	defer s.Close()
+
+	job := SshJob{Server: addr, ServerConfig: testClientConfig()}
+	_, _, attempts, err := s.connectRetry(&job, 0)
+	if err == nil {
+		env.Fatalf("expected connection error")
+	}
+	if attempts != 3 {
+		env.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	job.Server = server.Addr()
+	client, closer, attempts, err := s.connectRetry(&job, 0)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	closer()
+	if client == nil || attempts != 1 {
+		env.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestSsh_Cancel(env *testing.T) {
+	config := TsshConfig{}
+	s := NewSshSession(&config, 0)
+	defer s.Close()
+
+	if s.Cancelled() {
+		env.Errorf("new session should not be cancelled")
+	}
+
+	s.Cancel(ssh.SIGINT)
+	s.Cancel(ssh.SIGTERM) // no effect
+
+	if !s.Cancelled() || s.signal != ssh.SIGINT {
+		env.Errorf("session should be cancelled with SIGINT, got %v", s.signal)
+	}
+	if s.Run(&SshJob{}) {
+		env.Errorf("cancelled session should not run a new job")
+	}
+}
@@ -7,61 +7,175 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"syscall"
+	"sort"
+	"strings"
+	"time"
 
 	l "github.com/cinsk/triton-pssh/log"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
+// AuthMethods is the authentication methods for the SSH sessions.  The
+// private keys, the agent and the certificates are offered in a single
+// "publickey" method, since ssh.Client tries each method only once.
 type AuthMethods struct {
-	methods []ssh.AuthMethod
+	keys   []ssh.Signer
+	agents []func() ([]ssh.Signer, error)
+	certs  []authCertificate
+
+	password  bool          // use "password" and "keyboard-interactive" methods
+	passwords *PasswordFile // the passwords by the hosts, if any
+}
+
+// authCertificate is a certificate that is paired with the identity that
+// has the same public key, when the signers are requested.
+type authCertificate struct {
+	filename string
+	cert     *ssh.Certificate
 }
 
 func (m AuthMethods) String() string {
 	buf := bytes.Buffer{}
 
-	buf.WriteString(fmt.Sprintf("AuthMethod(len=%d){ methods={ ", len(m.methods)))
-	for _, me := range m.methods {
-		buf.WriteString(fmt.Sprintf("[%T]%v ", me, me))
-	}
-	buf.WriteString("} }")
+	buf.WriteString(fmt.Sprintf("AuthMethod{ keys=%d, agents=%d, certificates=%d, password=%v, passwordFile=%v }",
+		len(m.keys), len(m.agents), len(m.certs), m.password, m.passwords != nil))
 	return buf.String()
 }
 
 func (m *AuthMethods) AddDefaults() {
 	// the order is important here
-	m.AddPrivateKey(filepath.Join(HomeDirectory, ".ssh", "id_ed25519"))
-	m.AddPrivateKey(filepath.Join(HomeDirectory, ".ssh", "id_ecdsa"))
-	m.AddPrivateKey(filepath.Join(HomeDirectory, ".ssh", "id_dsa"))
-	m.AddPrivateKey(filepath.Join(HomeDirectory, ".ssh", "id_rsa"))
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_dsa", "id_rsa"} {
+		filename := filepath.Join(HomeDirectory, ".ssh", name)
+		if err := m.addPrivateKey(filename, false); err != nil && !os.IsNotExist(err) {
+			l.Debug("cannot use the default key %s: %s", filename, err)
+		}
+	}
 }
 
 func (m *AuthMethods) Methods() []ssh.AuthMethod {
-	return m.methods
+	return m.MethodsFor("", nil)
+}
+
+// MethodsFor returns the methods for the instance NAME that has TAGS, whose
+// password may be in the password file.
+func (m *AuthMethods) MethodsFor(name string, tags map[string]interface{}) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if len(m.keys) > 0 || len(m.agents) > 0 {
+		methods = append(methods, ssh.PublicKeysCallback(m.Signers))
+	}
+	if m.password {
+		methods = append(methods,
+			ssh.PasswordCallback(func() (string, error) { return m.Password(name, tags) }),
+			ssh.KeyboardInteractive(m.keyboardInteractive(name, tags)))
+	}
+	return methods
 }
 
-func (m *AuthMethods) prepend(method ssh.AuthMethod) {
-	m.methods = append([]ssh.AuthMethod{method}, m.methods...)
+// Signers returns the signers of the private keys and the agents.  The
+// certificates come first, since the servers that trust the CA may not
+// have the keys in authorized_keys.
+func (m *AuthMethods) Signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, key := range m.keys {
+		if es, ok := key.(*encryptedSigner); ok && es.Failed() {
+			continue
+		}
+		signers = append(signers, key)
+	}
+	for _, agentSigners := range m.agents {
+		s, err := agentSigners()
+		if err != nil {
+			l.Warn("warning: cannot get the keys from SSH agent: %s", err)
+			continue
+		}
+		signers = append(signers, s...)
+	}
+
+	var certs []ssh.Signer
+	for _, c := range m.certs {
+		signer := findSigner(signers, c.cert.Key)
+		if signer == nil {
+			l.Debug("no identity for the certificate %s", c.filename)
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(c.cert, signer)
+		if err != nil {
+			l.Debug("cannot use the certificate %s: %s", c.filename, err)
+			continue
+		}
+		certs = append(certs, certSigner)
+	}
+
+	// the certificates held by the agent
+	sort.SliceStable(signers, func(i, j int) bool {
+		return isCertificate(signers[i].PublicKey()) && !isCertificate(signers[j].PublicKey())
+	})
+	return append(certs, signers...), nil
+}
+
+func isCertificate(key ssh.PublicKey) bool {
+	if _, ok := key.(*ssh.Certificate); ok {
+		return true
+	}
+	// the agent keys are not parsed
+	return strings.HasSuffix(key.Type(), "-cert-v01@openssh.com")
+}
+
+func findSigner(signers []ssh.Signer, key ssh.PublicKey) ssh.Signer {
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			return signer
+		}
+	}
+	return nil
 }
 
-func (m *AuthMethods) AddPassword() error {
-	if !terminal.IsTerminal(int(syscall.Stdin)) {
-		return fmt.Errorf("stdin is not a terminal, required by password authentication")
+// CheckCertificates returns an error if a certificate has no identity,
+// either a private key or a key in the agent.
+func (m *AuthMethods) CheckCertificates() error {
+	if len(m.certs) == 0 {
+		return nil
+	}
+	signers, _ := m.Signers()
+	for _, c := range m.certs {
+		if findSigner(signers, c.cert.Key) == nil {
+			return fmt.Errorf("no identity for the certificate %s, use -I KEYFILE or --agent", c.filename)
+		}
 	}
+	return nil
+}
+
+// AddPassword adds the password and keyboard-interactive authentication.
+// The password is asked when a server needs it first, unless it is in the
+// password file or PASSWORD_ENV.
+func (m *AuthMethods) AddPassword() {
+	m.password = true
+}
 
-	fmt.Fprintf(os.Stderr, "password: ")
-	password, err := terminal.ReadPassword(int(syscall.Stdin))
-	fmt.Fprintf(os.Stderr, "\n")
+// AddPasswordFile adds the password authentication with the passwords in
+// FILENAME.  See LoadPasswordFile() for the format.
+func (m *AuthMethods) AddPasswordFile(filename string) error {
+	passwords, err := LoadPasswordFile(filename)
 	if err != nil {
 		return err
 	}
-	m.prepend(ssh.Password(string(password)))
+	m.password, m.passwords = true, passwords
 	return nil
 }
 
+// AddPrivateKey adds the private key FILENAME.  The certificate of the key,
+// FILENAME-cert.pub, is added too if it exists.  If the key is encrypted,
+// the passphrase is asked when a server accepts the key.
 func (m *AuthMethods) AddPrivateKey(filename string) error {
+	return m.addPrivateKey(filename, true)
+}
+
+// addPrivateKey adds the private key FILENAME.  If the encrypted key has no
+// public key (e.g. the legacy PEM format without FILENAME.pub), the
+// passphrase is asked right now only if ASK is true.
+func (m *AuthMethods) addPrivateKey(filename string, ask bool) error {
 	stat, err := os.Stat(filename)
 
 	if err != nil {
@@ -79,11 +193,59 @@ func (m *AuthMethods) AddPrivateKey(filename string) error {
 	}
 
 	key, err := ssh.ParsePrivateKey(buffer)
+	if perr, ok := err.(*ssh.PassphraseMissingError); ok {
+		key, err = newEncryptedSigner(filename, buffer, perr)
+		if err != nil && ask {
+			var raw interface{}
+			if raw, err = DecryptPrivateKey(filename, buffer); err == nil {
+				key, err = ssh.NewSignerFromKey(raw)
+			}
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("cannot parse key file from %s: %s", filename, err)
 	}
 
-	m.prepend(ssh.PublicKeys(key))
+	m.keys = append([]ssh.Signer{key}, m.keys...)
+
+	if certfile := filename + "-cert.pub"; IsExist(certfile) {
+		if err := m.AddCertificate(certfile); err != nil {
+			l.Warn("warning: %s", err)
+		}
+	}
+	return nil
+}
+
+// AddCertificate adds the OpenSSH user certificate FILENAME.  It is used
+// with the private key or the agent key that has the same public key.
+func (m *AuthMethods) AddCertificate(filename string) error {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read certificate file(%s): %s", filename, err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+	if err != nil {
+		return fmt.Errorf("cannot parse certificate file from %s: %s", filename, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("not a certificate: %s", filename)
+	}
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("not a user certificate: %s", filename)
+	}
+
+	now := uint64(time.Now().Unix())
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		return fmt.Errorf("certificate %s expired at %s", filename, time.Unix(int64(cert.ValidBefore), 0))
+	}
+	if now < cert.ValidAfter {
+		return fmt.Errorf("certificate %s is not valid until %s", filename, time.Unix(int64(cert.ValidAfter), 0))
+	}
+
+	l.Debug("certificate %s: id=%s, principals=%v", filename, cert.KeyId, cert.ValidPrincipals)
+	m.certs = append([]authCertificate{{filename: filename, cert: cert}}, m.certs...)
 	return nil
 }
 
@@ -100,7 +262,7 @@ func (m *AuthMethods) AddAgent() error {
 		return err
 	}
 
-	m.prepend(ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+	m.agents = append(m.agents, agent.NewClient(sshAgent).Signers)
 	return nil
 }
 
@@ -110,17 +272,11 @@ func PasswordAuth() ssh.AuthMethod {
 			return
 		}
 
-		if !terminal.IsTerminal(int(syscall.Stdin)) {
-			l.ErrQuit(1, "stdin is not a terminal, required by password authentication")
-		}
-
-		fmt.Fprintf(os.Stderr, "password: ")
-		password, err := terminal.ReadPassword(int(syscall.Stdin))
-		fmt.Fprintf(os.Stderr, "\n")
+		password, err := AskSecret("password: ")
 		if err != nil {
-			l.ErrQuit(1, "cannot read password")
+			l.ErrQuit(1, "cannot read password: %v", err)
 		}
-		Config.passwordAuth = ssh.Password(string(password))
+		Config.passwordAuth = ssh.Password(password)
 	})
 	return Config.passwordAuth
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(env *testing.T) (ssh.Signer, []byte) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		env.Fatalf("cannot generate a key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		env.Fatalf("cannot create a signer: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		env.Fatalf("cannot marshal the key: %v", err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// writeTestCertificate writes the certificate of KEY signed by CA to FILENAME.
+func writeTestCertificate(env *testing.T, filename string, ca ssh.Signer, key ssh.PublicKey, validBefore time.Time) {
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "test",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		env.Fatalf("cannot sign the certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		env.Fatal(err)
+	}
+}
+
+func TestSshAuth_Certificate(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := newTestSigner(env)
+	key, pemBytes := newTestSigner(env)
+	keyfile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyfile, pemBytes, 0600); err != nil {
+		env.Fatal(err)
+	}
+	writeTestCertificate(env, keyfile+"-cert.pub", ca, key.PublicKey(), time.Now().Add(time.Hour))
+
+	auth := AuthMethods{}
+	if err := auth.AddPrivateKey(keyfile); err != nil {
+		env.Fatalf("AddPrivateKey failed: %v", err)
+	}
+	if err := auth.CheckCertificates(); err != nil {
+		env.Errorf("CheckCertificates failed: %v", err)
+	}
+
+	signers, _ := auth.Signers()
+	if len(signers) != 2 {
+		env.Fatalf("expected the certificate and the key, got %d signers", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*ssh.Certificate); !ok {
+		env.Errorf("the certificate should come first, got %s", signers[0].PublicKey().Type())
+	}
+
+	// the server trusts only the CA
+	server := newTestSshServer(env)
+	defer server.Close()
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	server.Configure(func(c *ssh.ServerConfig) {
+		c.NoClientAuth = false
+		c.PublicKeyCallback = checker.Authenticate
+	})
+
+	config := testClientConfig()
+	config.Auth = auth.Methods()
+	client, err := ssh.Dial("tcp", server.Addr(), config)
+	if err != nil {
+		env.Fatalf("cannot authenticate with the certificate: %v", err)
+	}
+	client.Close()
+}
+
+func TestSshAuth_Certificate_Invalid(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := newTestSigner(env)
+	key, _ := newTestSigner(env)
+
+	expired := filepath.Join(dir, "expired-cert.pub")
+	writeTestCertificate(env, expired, ca, key.PublicKey(), time.Now().Add(-time.Hour))
+	auth := AuthMethods{}
+	if err := auth.AddCertificate(expired); err == nil {
+		env.Errorf("expected error for the expired certificate")
+	}
+
+	// no private key for the certificate
+	orphan := filepath.Join(dir, "orphan-cert.pub")
+	writeTestCertificate(env, orphan, ca, key.PublicKey(), time.Now().Add(time.Hour))
+	if err := auth.AddCertificate(orphan); err != nil {
+		env.Fatalf("AddCertificate failed: %v", err)
+	}
+	if err := auth.CheckCertificates(); err == nil {
+		env.Errorf("expected error for the certificate without the identity")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joyent/triton-go/compute"
+)
+
+const SSH_CONFIG_HEADER = "# Generated by triton-pssh ssh-config; do not edit.\n"
+
+// SshConfigHost is a Host block of ssh_config(5) for an instance.
+type SshConfigHost struct {
+	Name      string
+	HostName  string
+	User      string
+	Port      int
+	ProxyJump string // empty if the instance is reachable directly
+}
+
+// NewSshConfigHost returns the Host block of INSTANCE, whose image is IMG.
+// The user and the bastion servers are determined in the same way as
+// BuildJob().
+func NewSshConfigHost(instance *compute.Instance, img *compute.Image, config *TsshConfig) (SshConfigHost, error) {
+	host := SshConfigHost{
+		Name:     instance.Name,
+		HostName: instance.PrimaryIP,
+		User:     config.User,
+		Port:     config.ServerPort,
+	}
+	if host.Name == "" {
+		host.Name = instance.ID
+	}
+	if host.User == "" {
+		host.User = DefaultUser(img)
+	}
+
+	public := NetCache.HasPublic(instance)
+	if !public && len(config.Bastions) == 0 {
+		return host, fmt.Errorf("cannot connect to the instance(%s) without bastion server", instance.Name)
+	}
+	if !public || config.ForceBastionOnPublicHost {
+		host.ProxyJump = ProxyJump(config.Bastions)
+	}
+	return host, nil
+}
+
+// ProxyJump returns the value of ProxyJump option for HOPS.
+func ProxyJump(hops []BastionHop) string {
+	jumps := []string{}
+	for _, hop := range hops {
+		// brackets for the IPv6 addresses
+		jumps = append(jumps, fmt.Sprintf("%s@%s", hop.User, net.JoinHostPort(hop.Address, strconv.Itoa(hop.Port))))
+	}
+	return strings.Join(jumps, ",")
+}
+
+// WriteSshConfig writes the Host blocks of HOSTS in the order of the names,
+// so that the same instances always produce the same output.
+func WriteSshConfig(out *bytes.Buffer, hosts []SshConfigHost) {
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+
+	out.WriteString(SSH_CONFIG_HEADER)
+	for _, host := range hosts {
+		out.WriteString(fmt.Sprintf("\nHost %s\n", host.Name))
+		out.WriteString(fmt.Sprintf("    HostName %s\n", host.HostName))
+		out.WriteString(fmt.Sprintf("    User %s\n", host.User))
+		out.WriteString(fmt.Sprintf("    Port %d\n", host.Port))
+		if host.ProxyJump != "" {
+			out.WriteString(fmt.Sprintf("    ProxyJump %s\n", host.ProxyJump))
+		}
+	}
+}
+
+// UpdateFile replaces the content of FILENAME with DATA.  The file is not
+// touched if it already has DATA.  It returns true if the file was updated.
+func UpdateFile(filename string, data []byte) (bool, error) {
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return false, err
+	}
+
+	tmpname := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpname, data, 0644); err != nil {
+		return false, fmt.Errorf("cannot write file(%s): %s", tmpname, err)
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		os.Remove(tmpname)
+		return false, fmt.Errorf("cannot replace file(%s): %s", filename, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSshConfig_WriteSshConfig(env *testing.T) {
+	hosts := []SshConfigHost{
+		{Name: "nexus", HostName: "10.0.0.7", User: "ubuntu", Port: 22,
+			ProxyJump: ProxyJump([]BastionHop{{User: "admin", Address: "1.2.3.4", Port: 2222}, {User: "root", Address: "10.0.0.2", Port: 22}})},
+		{Name: "bastion", HostName: "1.2.3.4", User: "admin", Port: 22},
+	}
+
+	out := bytes.Buffer{}
+	WriteSshConfig(&out, hosts)
+
+	expected := `# Generated by triton-pssh ssh-config; do not edit.
+
+Host bastion
+    HostName 1.2.3.4
+    User admin
+    Port 22
+
+Host nexus
+    HostName 10.0.0.7
+    User ubuntu
+    Port 22
+    ProxyJump admin@1.2.3.4:2222,root@10.0.0.2:22
+`
+	if out.String() != expected {
+		env.Errorf("expected |%v|, got |%v|", expected, out.String())
+	}
+}
+
+func TestSshConfig_ProxyJump(env *testing.T) {
+	cases := []struct {
+		hops     []BastionHop
+		expected string
+	}{
+		{[]BastionHop{{User: "admin", Address: "1.2.3.4", Port: 2222}}, "admin@1.2.3.4:2222"},
+		{[]BastionHop{{User: "admin", Address: "2001:db8::1", Port: 22}, {User: "root", Address: "fd00::2", Port: 2222}},
+			"admin@[2001:db8::1]:22,root@[fd00::2]:2222"},
+	}
+	for _, c := range cases {
+		if got := ProxyJump(c.hops); got != c.expected {
+			env.Errorf("expected |%s|, got |%s|", c.expected, got)
+		}
+	}
+}
+
+func TestSshConfig_UpdateFile(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "ssh", "config")
+
+	for i, c := range []struct {
+		data    string
+		updated bool
+	}{
+		{"Host a\n", true},
+		{"Host a\n", false},
+		{"Host b\n", true},
+	} {
+		updated, err := UpdateFile(filename, []byte(c.data))
+		if err != nil {
+			env.Fatalf("unexpected error: %v", err)
+		}
+		if updated != c.updated {
+			env.Errorf("case %d: expected updated=%v, got %v", i, c.updated, updated)
+		}
+		data, _ := ioutil.ReadFile(filename)
+		if string(data) != c.data {
+			env.Errorf("case %d: expected |%s|, got |%s|", i, c.data, data)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/logrusorgru/aurora"
+)
+
+var streamPalette = []aurora.Color{
+	aurora.CyanFg,
+	aurora.GreenFg,
+	aurora.YellowFg,
+	aurora.BlueFg,
+	aurora.MagentaFg,
+	aurora.CyanFg | aurora.BrightFg,
+	aurora.GreenFg | aurora.BrightFg,
+	aurora.YellowFg | aurora.BrightFg,
+	aurora.BlueFg | aurora.BrightFg,
+	aurora.MagentaFg | aurora.BrightFg,
+}
+
+// StreamPrinter writes the output of multiple hosts line by line as it
+// arrives.  Each line is prefixed with the instance name, and only complete
+// lines are written so that the lines of different hosts never interleave.
+type StreamPrinter struct {
+	color aurora.Aurora
+
+	mutex  sync.Mutex
+	colors map[string]aurora.Color
+}
+
+func NewStreamPrinter(color aurora.Aurora) *StreamPrinter {
+	return &StreamPrinter{color: color, colors: make(map[string]aurora.Color)}
+}
+
+func (p *StreamPrinter) prefix(name string) []byte {
+	p.mutex.Lock()
+	c, ok := p.colors[name]
+	if !ok {
+		c = streamPalette[len(p.colors)%len(streamPalette)]
+		p.colors[name] = c
+	}
+	p.mutex.Unlock()
+
+	return []byte(p.color.Sprintf("%s: ", p.color.Colorize(name, c)))
+}
+
+// Writer returns a LineWriter that writes the lines of the host NAME to OUT.
+func (p *StreamPrinter) Writer(out io.Writer, name string) *LineWriter {
+	return &LineWriter{printer: p, out: out, prefix: p.prefix(name)}
+}
+
+func (p *StreamPrinter) writeLine(out io.Writer, prefix []byte, line []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	buf := make([]byte, 0, len(prefix)+len(line)+1)
+	buf = append(buf, prefix...)
+	buf = append(buf, line...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	_, err := out.Write(buf)
+	return err
+}
+
+// LineWriter buffers a partial line until the newline arrives.
+type LineWriter struct {
+	printer *StreamPrinter
+	out     io.Writer
+	prefix  []byte
+	partial []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	data := p
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, data...)
+			break
+		}
+
+		line := data[:i+1]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = nil
+		}
+		if err := w.printer.writeLine(w.out, w.prefix, line); err != nil {
+			return len(p) - len(data), err
+		}
+		data = data[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close writes the remaining partial line, if any.
+func (w *LineWriter) Close() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	line := w.partial
+	w.partial = nil
+	return w.printer.writeLine(w.out, w.prefix, line)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/logrusorgru/aurora"
+)
+
+func TestStream_LineWriter_PartialLines(env *testing.T) {
+	out := bytes.Buffer{}
+	printer := NewStreamPrinter(aurora.NewAurora(false))
+
+	w1 := printer.Writer(&out, "host1")
+	w2 := printer.Writer(&out, "host2")
+
+	w1.Write([]byte("hel"))
+	w2.Write([]byte("foo\nba"))
+	w1.Write([]byte("lo\nwor"))
+	w2.Write([]byte("r\n"))
+	w1.Write([]byte("ld"))
+	w1.Close()
+	w2.Close()
+
+	expected := "host2: foo\nhost1: hello\nhost2: bar\nhost1: world\n"
+	if out.String() != expected {
+		env.Errorf("expected |%v|, got |%v|", expected, out.String())
+	}
+}
+
+func TestStream_LineWriter_MultipleLines(env *testing.T) {
+	out := bytes.Buffer{}
+	printer := NewStreamPrinter(aurora.NewAurora(false))
+
+	w := printer.Writer(&out, "host")
+	n, err := w.Write([]byte("a\nb\n\nc"))
+	if err != nil || n != 6 {
+		env.Errorf("unexpected Write() result: n = %d, err = %v", n, err)
+	}
+	w.Close()
+
+	expected := "host: a\nhost: b\nhost: \nhost: c\n"
+	if out.String() != expected {
+		env.Errorf("expected |%v|, got |%v|", expected, out.String())
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// SUDO_PROMPT is the password prompt given to sudo(8), so that it can be
+// told from the output of the command.  It must not have '%', which sudo
+// expands.
+const SUDO_PROMPT = "<triton-pssh:sudo-password>"
+
+// SUDO_READY is printed by the wrapped command when sudo(8) has accepted
+// the user.  The standard input is sent only after it.
+const SUDO_READY = "<triton-pssh:sudo-ready>"
+
+// SUDO_PASSWORD_ENV is the environment variable that has the sudo password.
+const SUDO_PASSWORD_ENV = "TRITON_PSSH_SUDO_PASSWORD"
+
+// SudoCommand wraps the shell COMMAND to run it as USER (root if empty)
+// with sudo(8).  The password is read from the standard input.
+func SudoCommand(command string, user string) string {
+	words := []string{"sudo", "-S", "-p", SUDO_PROMPT}
+	if user != "" {
+		words = append(words, "-u", user)
+	}
+	inner := fmt.Sprintf("echo %s >&2; %s", shellquote.Join(SUDO_READY), command)
+	return shellquote.Join(append(words, "--", "/bin/sh", "-c", inner)...)
+}
+
+// SudoPassword returns the sudo password.  It is read only once from
+// Config.SudoPasswordFile, SUDO_PASSWORD_ENV, or AskSecret() in order.
+func SudoPassword() (string, error) {
+	Config.sudoOnce.Do(func() {
+		Config.sudoPassword, Config.sudoError = readSudoPassword()
+	})
+	return Config.sudoPassword, Config.sudoError
+}
+
+func readSudoPassword() (string, error) {
+	if filename := Config.SudoPasswordFile; filename != "" {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		bits := stat.Mode().Perm() & (S_IRGRP | S_IWGRP | S_IXGRP | S_IROTH | S_IWOTH | S_IXOTH)
+		if int(bits) != 0 {
+			return "", fmt.Errorf("wrong permission for the password file: %s", filename)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("cannot read password file(%s): %s", filename, err)
+		}
+		return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+	}
+
+	if password, ok := os.LookupEnv(SUDO_PASSWORD_ENV); ok {
+		return password, nil
+	}
+
+	password, err := AskSecret("sudo password: ")
+	if err != nil {
+		return "", fmt.Errorf("%s, use --sudo-password-file or %s", err, SUDO_PASSWORD_ENV)
+	}
+	return password, nil
+}
+
+// SudoResponder answers the password prompt of sudo(8) in the outputs of a
+// command, and holds the standard input of the command until sudo accepts
+// the user.
+type SudoResponder struct {
+	password func() (string, error)
+	stdin    io.Writer
+	pty      bool
+
+	mu      sync.Mutex
+	prompts int
+	err     error
+
+	gate   chan struct{} // closed when the input can be sent, or never will be
+	ready  bool
+	closed sync.Once
+}
+
+// NewSudoResponder returns the responder that writes the password from
+// PASSWORD to STDIN.  PTY should be true if STDIN is a PTY.
+func NewSudoResponder(stdin io.Writer, pty bool, password func() (string, error)) *SudoResponder {
+	return &SudoResponder{password: password, stdin: stdin, pty: pty, gate: make(chan struct{})}
+}
+
+func (r *SudoResponder) open(ready bool) {
+	r.closed.Do(func() {
+		r.ready = ready
+		close(r.gate)
+	})
+}
+
+// done returns true if sudo has accepted the user, or has failed.
+func (r *SudoResponder) done() bool {
+	select {
+	case <-r.gate:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *SudoResponder) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	if r.pty {
+		// EOF to sudo, since closing the input does not reach a PTY
+		r.stdin.Write([]byte{4})
+	}
+	r.open(false)
+}
+
+func (r *SudoResponder) handle(token string) {
+	switch token {
+	case SUDO_READY:
+		r.open(true)
+	case SUDO_PROMPT:
+		r.mu.Lock()
+		r.prompts++
+		prompts := r.prompts
+		if prompts > 1 {
+			r.fail(fmt.Errorf("incorrect sudo password"))
+		}
+		r.mu.Unlock()
+		if prompts > 1 {
+			return
+		}
+
+		// the password may be asked on the terminal, so it is not
+		// taken under the lock
+		password, err := r.password()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err != nil {
+			r.fail(fmt.Errorf("sudo password required: %s", err))
+			return
+		}
+		if _, err := io.WriteString(r.stdin, password+"\n"); err != nil {
+			r.fail(fmt.Errorf("cannot send sudo password: %s", err))
+		}
+	}
+}
+
+// Err returns the reason why sudo failed, if any.
+func (r *SudoResponder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close releases the input held by Input(), if sudo has not accepted the
+// user yet.
+func (r *SudoResponder) Close() {
+	r.open(false)
+}
+
+// Input returns the reader of SRC that blocks until sudo accepts the user.
+// It returns io.EOF if sudo failed, or if SRC is nil.
+func (r *SudoResponder) Input(src io.Reader) io.Reader {
+	return &sudoInput{r: r, src: src}
+}
+
+type sudoInput struct {
+	r   *SudoResponder
+	src io.Reader
+}
+
+func (in *sudoInput) Read(p []byte) (int, error) {
+	<-in.r.gate
+	if !in.r.ready || in.src == nil {
+		return 0, io.EOF
+	}
+	return in.src.Read(p)
+}
+
+// Reader returns the reader of the command output SRC, which has the
+// prompts and the ready marker removed.  After sudo accepts the user, SRC
+// is passed as it is.
+func (r *SudoResponder) Reader(src io.Reader) io.Reader {
+	return &sudoFilter{r: r, src: src, chunk: make([]byte, 4096)}
+}
+
+type sudoFilter struct {
+	r     *SudoResponder
+	src   io.Reader
+	chunk []byte
+	buf   []byte // the output that may be the start of a token
+	out   []byte // the filtered output not returned yet
+	skip  bool   // true to remove the newline after a token
+	err   error
+}
+
+func (f *sudoFilter) Read(p []byte) (int, error) {
+	for len(f.out) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		n, err := f.src.Read(f.chunk)
+		f.buf = append(f.buf, f.chunk[:n]...)
+		f.err = err
+		f.scan(err != nil)
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+func (f *sudoFilter) scan(flush bool) {
+	for len(f.buf) > 0 {
+		if f.skip {
+			if len(f.buf) == 1 && f.buf[0] == '\r' && !flush {
+				return
+			}
+			if bytes.HasPrefix(f.buf, []byte("\r\n")) {
+				f.buf = f.buf[2:]
+			} else if f.buf[0] == '\n' {
+				f.buf = f.buf[1:]
+			}
+			f.skip = false
+			continue
+		}
+
+		if f.r.done() {
+			f.out = append(f.out, f.buf...)
+			f.buf = nil
+			return
+		}
+
+		i, token := indexSudoToken(f.buf)
+		if i < 0 {
+			keep := 0
+			if !flush {
+				keep = partialSudoToken(f.buf)
+			}
+			f.out = append(f.out, f.buf[:len(f.buf)-keep]...)
+			f.buf = append([]byte{}, f.buf[len(f.buf)-keep:]...)
+			return
+		}
+		f.out = append(f.out, f.buf[:i]...)
+		f.buf = f.buf[i+len(token):]
+		f.skip = true
+		f.r.handle(token)
+	}
+}
+
+var sudoTokens = []string{SUDO_PROMPT, SUDO_READY}
+
+// indexSudoToken returns the index and the token that appears first in BUF,
+// or -1 if none.
+func indexSudoToken(buf []byte) (int, string) {
+	index, found := -1, ""
+	for _, token := range sudoTokens {
+		if i := bytes.Index(buf, []byte(token)); i >= 0 && (index < 0 || i < index) {
+			index, found = i, token
+		}
+	}
+	return index, found
+}
+
+// partialSudoToken returns the length of the longest suffix of BUF that is
+// the start of a token.
+func partialSudoToken(buf []byte) int {
+	longest := 0
+	for _, token := range sudoTokens {
+		for n := len(token) - 1; n > longest; n-- {
+			if bytes.HasSuffix(buf, []byte(token[:n])) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
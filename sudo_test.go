@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSudo_SudoCommand(env *testing.T) {
+	expected := `sudo -S -p \<triton-pssh:sudo-password\> -u kafka -- /bin/sh -c 'echo \<triton-pssh:sudo-ready\> >&2; id -un'`
+	if got := SudoCommand("id -un", "kafka"); got != expected {
+		env.Errorf("expected |%s|, got |%s|", expected, got)
+	}
+}
+
+func TestSudo_Responder(env *testing.T) {
+	stdin := bytes.Buffer{}
+	r := NewSudoResponder(&stdin, false, func() (string, error) { return "secret", nil })
+
+	output := "motd\n" + SUDO_PROMPT + "\n" + SUDO_READY + "\nroot\n" + SUDO_PROMPT
+	// one byte at a time, so that the tokens are split
+	out, err := ioutil.ReadAll(r.Reader(iotest.OneByteReader(strings.NewReader(output))))
+	if err != nil {
+		env.Fatal(err)
+	}
+	expected := "motd\nroot\n" + SUDO_PROMPT
+	if string(out) != expected {
+		env.Errorf("expected |%s|, got |%s|", expected, out)
+	}
+	if stdin.String() != "secret\n" {
+		env.Errorf("expected the password, got |%s|", stdin.String())
+	}
+	if r.Err() != nil {
+		env.Errorf("unexpected error: %v", r.Err())
+	}
+
+	input, err := ioutil.ReadAll(r.Input(strings.NewReader("data")))
+	if err != nil || string(input) != "data" {
+		env.Errorf("expected the input |data|, got |%s|, %v", input, err)
+	}
+}
+
+func TestSudo_Responder_Failure(env *testing.T) {
+	stdin := bytes.Buffer{}
+	r := NewSudoResponder(&stdin, true, func() (string, error) { return "wrong", nil })
+
+	output := SUDO_PROMPT + "\r\nSorry, try again.\r\n" + SUDO_PROMPT
+	out, _ := ioutil.ReadAll(r.Reader(strings.NewReader(output)))
+	if string(out) != "Sorry, try again.\r\n" {
+		env.Errorf("expected |Sorry, try again.\\r\\n|, got |%s|", out)
+	}
+	if r.Err() == nil {
+		env.Errorf("expected error for the incorrect password")
+	}
+	if stdin.String() != "wrong\n\x04" {
+		env.Errorf("expected the password and EOF, got |%q|", stdin.String())
+	}
+	if n, err := r.Input(strings.NewReader("data")).Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		env.Errorf("expected EOF from the input, got %d, %v", n, err)
+	}
+
+	r = NewSudoResponder(&stdin, false, func() (string, error) { return "", fmt.Errorf("no terminal") })
+	ioutil.ReadAll(r.Reader(strings.NewReader(SUDO_PROMPT)))
+	if r.Err() == nil {
+		env.Errorf("expected error without the password")
+	}
+}
+
+func TestSudo_Responder_AskWithoutLock(env *testing.T) {
+	stdin := bytes.Buffer{}
+	asking := make(chan struct{})
+	answer := make(chan struct{})
+	r := NewSudoResponder(&stdin, false, func() (string, error) {
+		close(asking)
+		<-answer
+		return "secret", nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ioutil.ReadAll(r.Reader(strings.NewReader(SUDO_PROMPT + "\n")))
+	}()
+	<-asking
+
+	errs := make(chan error, 1)
+	go func() { errs <- r.Err() }()
+	select {
+	case err := <-errs:
+		if err != nil {
+			env.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		env.Errorf("the responder is locked while the password is asked")
+	}
+
+	close(answer)
+	<-done
+	if stdin.String() != "secret\n" {
+		env.Errorf("expected the password, got |%s|", stdin.String())
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DEFAULT_KEEPALIVE_INTERVAL = 15 * time.Second
+	KEEPALIVE_MAX_MISSED       = 3 // close the connection after this many unanswered keepalives
+	KEEPALIVE_REQUEST          = "keepalive@openssh.com"
+)
+
+// keepalive sends KEEPALIVE_REQUEST to CLIENT every INTERVAL, until the
+// connection is closed.  Any reply (even a failure) means that the server
+// is alive.  If the server does not reply to KEEPALIVE_MAX_MISSED requests
+// in a row, CLIENT is closed, so that the jobs using it do not hang on a
+// dead connection.
+func keepalive(client *ssh.Client, interval time.Duration) {
+	missed := 0
+	for {
+		time.Sleep(interval)
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest(KEEPALIVE_REQUEST, true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				// the connection is closed
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= KEEPALIVE_MAX_MISSED {
+				l.Debug("keepalive: no reply from %s for %d request(s); closing the connection", client.RemoteAddr(), missed)
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// Watchdog interrupts a job that runs longer than the command timeout, or
+// that has no activity on its standard input and outputs for the idle
+// timeout.  A zero timeout disables the corresponding check.
+type Watchdog struct {
+	command time.Duration
+	idle    time.Duration
+
+	last    int64 // the time of the last activity in UnixNano
+	expired int32 // 1 if the job timed out
+	done    chan struct{}
+}
+
+func NewWatchdog(command time.Duration, idle time.Duration) *Watchdog {
+	w := &Watchdog{command: command, idle: idle, done: make(chan struct{})}
+	w.Touch()
+	return w
+}
+
+// Start watches the job in the background.  On a timeout, it calls
+// INTERRUPT if not nil, and closes CLIENT if the job does not finish in the
+// grace period.
+func (w *Watchdog) Start(client *ssh.Client, interrupt func(), wid int) {
+	if w.command <= 0 && w.idle <= 0 {
+		return
+	}
+
+	go func() {
+		reason := w.wait()
+		if reason == "" {
+			return
+		}
+		atomic.StoreInt32(&w.expired, 1)
+		l.Debug("SshWorker[%d]: %s exceeded", wid, reason)
+
+		if interrupt != nil {
+			interrupt()
+		}
+		select {
+		case <-w.done:
+		case <-time.After(CANCEL_GRACE_PERIOD):
+			l.Debug("SshWorker[%d]: closing the connection after the grace period", wid)
+			client.Close()
+		}
+	}()
+}
+
+// wait returns the reason of the timeout, or "" if the job finished.
+func (w *Watchdog) wait() string {
+	var command, idle <-chan time.Time
+
+	if w.command > 0 {
+		t := time.NewTimer(w.command)
+		defer t.Stop()
+		command = t.C
+	}
+	var idleTimer *time.Timer
+	if w.idle > 0 {
+		idleTimer = time.NewTimer(w.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return ""
+		case <-command:
+			return "command timeout"
+		case <-idle:
+			since := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&w.last))
+			if since >= w.idle {
+				return "idle timeout"
+			}
+			idleTimer.Reset(w.idle - since)
+		}
+	}
+}
+
+// Stop tells the watchdog that the job finished.
+func (w *Watchdog) Stop() {
+	close(w.done)
+}
+
+// Touch records an activity of the job.
+func (w *Watchdog) Touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// Expired returns true if the job was interrupted by the watchdog.
+func (w *Watchdog) Expired() bool {
+	return atomic.LoadInt32(&w.expired) != 0
+}
+
+// Reader returns a reader that records an activity on each read from R.
+func (w *Watchdog) Reader(r io.Reader) io.Reader {
+	return &watchedReader{r, w}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *Watchdog
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.Touch()
+	}
+	return n, err
+}
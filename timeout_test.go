@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog_IdleTimeout(env *testing.T) {
+	w := NewWatchdog(0, 50*time.Millisecond)
+
+	interrupted := make(chan struct{})
+	w.Start(nil, func() { close(interrupted) }, 0)
+
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		env.Fatalf("the idle job was not interrupted")
+	}
+	w.Stop()
+
+	if !w.Expired() {
+		env.Errorf("expected the watchdog to be expired")
+	}
+}
+
+func TestWatchdog_Activity(env *testing.T) {
+	w := NewWatchdog(0, 200*time.Millisecond)
+
+	interrupted := make(chan struct{})
+	w.Start(nil, func() { close(interrupted) }, 0)
+
+	// the reads keep the job alive longer than the idle timeout
+	r := w.Reader(strings.NewReader(strings.Repeat("x", 6)))
+	for i := 0; i < 6; i++ {
+		var b [1]byte
+		r.Read(b[:])
+		time.Sleep(50 * time.Millisecond)
+	}
+	w.Stop()
+
+	select {
+	case <-interrupted:
+		env.Errorf("the active job was interrupted")
+	default:
+	}
+	if w.Expired() {
+		env.Errorf("expected the watchdog not to be expired")
+	}
+}
+
+func TestWatchdog_CommandTimeout(env *testing.T) {
+	w := NewWatchdog(50*time.Millisecond, time.Hour)
+
+	interrupted := make(chan struct{})
+	w.Start(nil, func() { close(interrupted) }, 0)
+
+	// the activity does not extend the command timeout
+	r := w.Reader(bytes.NewReader(make([]byte, 1024)))
+	go ioutil.ReadAll(r)
+
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		env.Fatalf("the job was not interrupted")
+	}
+	w.Stop()
+
+	if !w.Expired() {
+		env.Errorf("expected the watchdog to be expired")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type TransferDirection int
+
+const (
+	TRANSFER_UPLOAD TransferDirection = iota
+	TRANSFER_DOWNLOAD
+)
+
+// TransferSpec describes the file transfer of SshJob over SFTP.
+type TransferSpec struct {
+	Direction   TransferDirection
+	Sources     []string
+	Destination string
+}
+
+type transferStat struct {
+	files int
+	bytes int64
+}
+
+// TransferSummary accumulates the results of the transfer jobs.
+type TransferSummary struct {
+	Hosts  int
+	Files  int
+	Bytes  int64
+	Failed []string
+}
+
+func (t *TransferSummary) Add(result *SshResult) {
+	t.Hosts++
+	t.Files += result.Files
+	t.Bytes += result.Bytes
+	if result.Status != nil {
+		t.Failed = append(t.Failed, result.InstanceName)
+	}
+}
+
+func (t *TransferSummary) String() string {
+	msg := fmt.Sprintf("transferred %d file(s), %d bytes from/to %d host(s)", t.Files, t.Bytes, t.Hosts)
+	if len(t.Failed) > 0 {
+		msg += fmt.Sprintf("; %d host(s) failed: %s", len(t.Failed), strings.Join(t.Failed, ", "))
+	}
+	return msg
+}
+
+func (s *SshSession) doTransfer(client *ssh.Client, job *SshJob, wid int) SshResult {
+	result := SshResult{Server: job.Server, InstanceID: job.InstanceID, InstanceName: job.InstanceName, User: job.ServerConfig.User}
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		result.Time = time.Now()
+		result.Status = fmt.Errorf("cannot start SFTP session: %s", err)
+		return result
+	}
+	defer sc.Close()
+
+	stat := transferStat{}
+	switch job.Transfer.Direction {
+	case TRANSFER_UPLOAD:
+		err = upload(sc, job.Transfer.Sources, job.Transfer.Destination, &stat)
+	case TRANSFER_DOWNLOAD:
+		err = download(sc, job.Transfer.Sources, job.Transfer.Destination, &stat)
+	default:
+		panic(fmt.Sprintf("unsupported transfer direction=%d", job.Transfer.Direction))
+	}
+	l.Debug("SshWorker[%d].doTransfer: %d file(s), %d bytes, err = %v", wid, stat.files, stat.bytes, err)
+
+	result.Time = time.Now()
+	result.Status = err
+	result.Files = stat.files
+	result.Bytes = stat.bytes
+	return result
+}
+
+// upload copies local SOURCES to the remote DEST.  If there are multiple
+// sources, or DEST is an existing directory, the sources are copied into
+// DEST.  Directories are copied recursively.  The permission bits and the
+// modification time of each file are preserved.
+func upload(sc *sftp.Client, sources []string, dest string, stat *transferStat) error {
+	into := len(sources) > 1 || dest == "" || dest[len(dest)-1] == '/'
+	if !into {
+		if fi, err := sc.Stat(dest); err == nil && fi.IsDir() {
+			into = true
+		}
+	}
+	if into && dest != "" {
+		if err := sc.MkdirAll(dest); err != nil {
+			return fmt.Errorf("cannot create remote directory %s: %s", dest, err)
+		}
+	}
+
+	for _, src := range sources {
+		target := dest
+		if into {
+			target = path.Join(dest, filepath.Base(src))
+		}
+		if err := uploadTree(sc, src, target, stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadTree(sc *sftp.Client, src string, dest string, stat *transferStat) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return uploadFile(sc, src, dest, info, stat)
+	}
+
+	// filepath.Walk() does not follow SRC if it is a symbolic link to a
+	// directory
+	root, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	var infos []os.FileInfo
+
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(rel))
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, err = os.Stat(p)
+			if err != nil || fi.IsDir() {
+				l.Warn("skipping symbolic link %s", p)
+				return nil
+			}
+		}
+
+		if fi.IsDir() {
+			if err := sc.MkdirAll(target); err != nil {
+				return fmt.Errorf("cannot create remote directory %s: %s", target, err)
+			}
+			dirs = append(dirs, target)
+			infos = append(infos, fi)
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			l.Warn("skipping non-regular file %s", p)
+			return nil
+		}
+		return uploadFile(sc, p, target, fi, stat)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directories are updated after their contents, otherwise the
+	// modification time will be overwritten.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		preserveRemote(sc, dirs[i], infos[i])
+	}
+	return nil
+}
+
+func uploadFile(sc *sftp.Client, src string, dest string, info os.FileInfo, stat *transferStat) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := sc.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("cannot create remote file %s: %s", dest, err)
+	}
+
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot upload %s to %s: %s", src, dest, err)
+	}
+
+	stat.files++
+	stat.bytes += n
+
+	preserveRemote(sc, dest, info)
+	return nil
+}
+
+func preserveRemote(sc *sftp.Client, name string, info os.FileInfo) {
+	if err := sc.Chmod(name, info.Mode().Perm()); err != nil {
+		l.Warn("cannot change the mode of %s: %s", name, err)
+	}
+	if err := sc.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		l.Warn("cannot change the modification time of %s: %s", name, err)
+	}
+}
+
+// download copies remote SOURCES into the local directory DEST.  Each
+// source may be a glob pattern, and directories are copied recursively.
+// The permission bits and the modification time of each file are
+// preserved.  The sources that have the same base name are rejected before
+// any transfer, since they would overwrite each other in DEST.
+func download(sc *sftp.Client, sources []string, dest string, stat *transferStat) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("cannot create a directory(%s): %s", dest, err)
+	}
+
+	var srcs []string
+	names := make(map[string]string) // base name -> source
+	for _, pattern := range sources {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			matches, err = sc.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("no remote file matched to %s", pattern)
+			}
+		}
+
+		for _, src := range matches {
+			base := path.Base(src)
+			if base == ".." || base == "." {
+				return fmt.Errorf("invalid remote file name %s", src)
+			}
+			if prev, ok := names[base]; ok {
+				if path.Clean(prev) == path.Clean(src) {
+					continue
+				}
+				return fmt.Errorf("remote files %s and %s have the same name %s", prev, src, base)
+			}
+			names[base] = src
+			srcs = append(srcs, src)
+		}
+	}
+
+	for _, src := range srcs {
+		if err := downloadTree(sc, src, filepath.Join(dest, path.Base(src)), stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadTree(sc *sftp.Client, src string, dest string, stat *transferStat) error {
+	info, err := sc.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot stat remote file %s: %s", src, err)
+	}
+	if !info.IsDir() {
+		return downloadFile(sc, src, dest, info, stat)
+	}
+
+	return downloadWalk(sc, sc.Walk(src), src, dest, stat)
+}
+
+// remoteWalker walks a remote directory tree, as *fs.Walker of sftp.Client.
+type remoteWalker interface {
+	Step() bool
+	Err() error
+	Path() string
+	Stat() os.FileInfo
+}
+
+// downloadWalk copies the files that WALKER finds under the remote
+// directory SRC into the local directory DEST.
+func downloadWalk(sc *sftp.Client, walker remoteWalker, src string, dest string, stat *transferStat) error {
+	var dirs []string
+	var infos []os.FileInfo
+
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("cannot walk remote directory %s: %s", src, err)
+		}
+		p := walker.Path()
+		fi := walker.Stat()
+
+		target, err := downloadTarget(src, p, dest)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("cannot create a directory(%s): %s", target, err)
+			}
+			dirs = append(dirs, target)
+			infos = append(infos, fi)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			l.Warn("skipping non-regular remote file %s", p)
+			continue
+		}
+		if err := downloadFile(sc, p, target, fi, stat); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		preserveLocal(dirs[i], infos[i])
+	}
+	return nil
+}
+
+// downloadTarget returns the local path of the remote file P under the
+// remote directory SRC, in the local directory DEST.  Since the names come
+// from the remote host, the path must not escape from DEST.
+func downloadTarget(src string, p string, dest string) (string, error) {
+	if !strings.HasPrefix(p, src) {
+		return "", fmt.Errorf("invalid remote file name %s, not under %s", p, src)
+	}
+	rel := strings.TrimPrefix(p[len(src):], "/")
+	if path.IsAbs(rel) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("invalid remote file name %s", p)
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid remote file name %s", p)
+		}
+	}
+
+	base := filepath.Clean(dest)
+	target := filepath.Join(base, filepath.FromSlash(rel))
+	if target != base && !strings.HasPrefix(target, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid remote file name %s, outside of %s", p, dest)
+	}
+	return target, nil
+}
+
+func downloadFile(sc *sftp.Client, src string, dest string, info os.FileInfo, stat *transferStat) error {
+	in, err := sc.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open remote file %s: %s", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot download %s to %s: %s", src, dest, err)
+	}
+
+	stat.files++
+	stat.bytes += n
+
+	preserveLocal(dest, info)
+	return nil
+}
+
+func preserveLocal(name string, info os.FileInfo) {
+	if err := os.Chmod(name, info.Mode().Perm()); err != nil {
+		l.Warn("cannot change the mode of %s: %s", name, err)
+	}
+	if err := os.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		l.Warn("cannot change the modification time of %s: %s", name, err)
+	}
+}
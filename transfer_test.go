@@ -0,0 +1,273 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSftpClient returns SFTP client connected to an in-process server
+// that serves the local filesystem, and the function to close both.
+func newTestSftpClient(env *testing.T) (*sftp.Client, func()) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	if err != nil {
+		env.Fatalf("cannot create SFTP server: %v", err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		env.Fatalf("cannot create SFTP client: %v", err)
+	}
+	return client, func() {
+		sw.Close()
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestTransfer_Upload(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0640)
+	ioutil.WriteFile(filepath.Join(src, "sub", "run.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime)
+
+	sc, closer := newTestSftpClient(env)
+	defer closer()
+
+	dest := filepath.Join(dir, "dest")
+	stat := transferStat{}
+	if err := upload(sc, []string{src}, dest+"/", &stat); err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	if stat.files != 2 || stat.bytes != 15 {
+		env.Errorf("expected 2 files, 15 bytes, got %d files, %d bytes", stat.files, stat.bytes)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "src", "a.txt"))
+	if err != nil {
+		env.Fatalf("uploaded file not found: %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		env.Errorf("expected mode 0640, got %o", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		env.Errorf("expected mtime %v, got %v", mtime, fi.ModTime())
+	}
+
+	fi, err = os.Stat(filepath.Join(dest, "src", "sub", "run.sh"))
+	if err != nil {
+		env.Fatalf("uploaded file not found: %v", err)
+	}
+	if fi.Mode().Perm() != 0755 {
+		env.Errorf("expected mode 0755, got %o", fi.Mode().Perm())
+	}
+}
+
+func TestTransfer_UploadSymlinkedDirectory(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	os.MkdirAll(target, 0755)
+	ioutil.WriteFile(filepath.Join(target, "a.txt"), []byte("hello"), 0644)
+	src := filepath.Join(dir, "src")
+	if err := os.Symlink(target, src); err != nil {
+		env.Fatalf("cannot create a symbolic link: %v", err)
+	}
+
+	sc, closer := newTestSftpClient(env)
+	defer closer()
+
+	dest := filepath.Join(dir, "dest")
+	stat := transferStat{}
+	if err := upload(sc, []string{src}, dest+"/", &stat); err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	if stat.files != 1 {
+		env.Errorf("expected 1 file, got %d files", stat.files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dest, "src", "a.txt"))
+	if err != nil || string(data) != "hello" {
+		env.Errorf("expected |hello| in src/a.txt, got |%s| (err = %v)", data, err)
+	}
+}
+
+func TestTransfer_UploadRename(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(src, []byte("hello"), 0600)
+
+	sc, closer := newTestSftpClient(env)
+	defer closer()
+
+	dest := filepath.Join(dir, "b.txt")
+	stat := transferStat{}
+	if err := upload(sc, []string{src}, dest, &stat); err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(dest)
+	if err != nil || string(data) != "hello" {
+		env.Errorf("expected |hello| in %s, got |%s| (err = %v)", dest, data, err)
+	}
+}
+
+func TestTransfer_Download(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote")
+	os.MkdirAll(filepath.Join(remote, "conf", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(remote, "server.log"), []byte("log1"), 0644)
+	ioutil.WriteFile(filepath.Join(remote, "gc.log"), []byte("log22"), 0600)
+	ioutil.WriteFile(filepath.Join(remote, "other.txt"), []byte("other"), 0644)
+	ioutil.WriteFile(filepath.Join(remote, "conf", "sub", "a.conf"), []byte("conf"), 0644)
+
+	sc, closer := newTestSftpClient(env)
+	defer closer()
+
+	local := filepath.Join(dir, "local", "host1")
+	stat := transferStat{}
+	err = download(sc, []string{filepath.Join(remote, "*.log"), filepath.Join(remote, "conf")}, local, &stat)
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	if stat.files != 3 || stat.bytes != 13 {
+		env.Errorf("expected 3 files, 13 bytes, got %d files, %d bytes", stat.files, stat.bytes)
+	}
+
+	for _, name := range []string{"server.log", "gc.log", filepath.Join("conf", "sub", "a.conf")} {
+		if !IsExist(filepath.Join(local, name)) {
+			env.Errorf("%s is not downloaded", name)
+		}
+	}
+	if IsExist(filepath.Join(local, "other.txt")) {
+		env.Errorf("other.txt should not be downloaded")
+	}
+
+	fi, err := os.Stat(filepath.Join(local, "gc.log"))
+	if err == nil && fi.Mode().Perm() != 0600 {
+		env.Errorf("expected mode 0600, got %o", fi.Mode().Perm())
+	}
+
+	err = download(sc, []string{filepath.Join(remote, "*.none")}, local, &stat)
+	if err == nil {
+		env.Errorf("expected error for unmatched pattern")
+	}
+}
+
+func TestTransfer_DownloadSameNames(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote")
+	os.MkdirAll(filepath.Join(remote, "app1"), 0755)
+	os.MkdirAll(filepath.Join(remote, "app2"), 0755)
+	ioutil.WriteFile(filepath.Join(remote, "app1", "server.log"), []byte("log1"), 0644)
+	ioutil.WriteFile(filepath.Join(remote, "app2", "server.log"), []byte("log2"), 0644)
+
+	sc, closer := newTestSftpClient(env)
+	defer closer()
+
+	local := filepath.Join(dir, "local", "host1")
+	stat := transferStat{}
+	err = download(sc, []string{filepath.Join(remote, "*", "server.log")}, local, &stat)
+	if err == nil {
+		env.Fatalf("expected error for the files of the same name")
+	}
+	for _, name := range []string{"app1", "app2"} {
+		if !strings.Contains(err.Error(), filepath.Join(remote, name, "server.log")) {
+			env.Errorf("expected %s in the error, got %v", name, err)
+		}
+	}
+	if stat.files != 0 || IsExist(filepath.Join(local, "server.log")) {
+		env.Errorf("nothing should be downloaded, got %d files", stat.files)
+	}
+
+	// the same file matched twice is downloaded once
+	err = download(sc, []string{filepath.Join(remote, "app1", "*.log"), filepath.Join(remote, "app1", "server.log")}, local, &stat)
+	if err != nil || stat.files != 1 {
+		env.Errorf("expected 1 file without error, got %d files (err = %v)", stat.files, err)
+	}
+}
+
+// testWalker is remoteWalker that reports the given names.
+type testWalker struct {
+	names []string
+	infos []os.FileInfo
+	index int
+}
+
+func (w *testWalker) Step() bool        { w.index++; return w.index <= len(w.names) }
+func (w *testWalker) Err() error        { return nil }
+func (w *testWalker) Path() string      { return w.names[w.index-1] }
+func (w *testWalker) Stat() os.FileInfo { return w.infos[w.index-1] }
+
+func TestTransfer_DownloadHostileNames(env *testing.T) {
+	dir, err := ioutil.TempDir("", "triton-pssh-test")
+	if err != nil {
+		env.Fatalf("cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		env.Fatal(err)
+	}
+	local := filepath.Join(dir, "local", "host1")
+
+	for _, name := range []string{"/data/../../evil", "/data/sub/../../../evil", "/data//etc/passwd", "/other/evil"} {
+		walker := &testWalker{names: []string{"/data", name}, infos: []os.FileInfo{dirInfo, dirInfo}}
+		if err := downloadWalk(nil, walker, "/data", local, &transferStat{}); err == nil {
+			env.Errorf("%s: expected error for the hostile name", name)
+		}
+	}
+	for _, name := range []string{"evil", "etc"} {
+		if IsExist(filepath.Join(dir, name)) || IsExist(filepath.Join(dir, "local", name)) {
+			env.Errorf("%s is created outside of the download directory", name)
+		}
+	}
+
+	if target, err := downloadTarget("/data", "/data/sub/a..b", local); err != nil || target != filepath.Join(local, "sub", "a..b") {
+		env.Errorf("expected %s, got %s, %v", filepath.Join(local, "sub", "a..b"), target, err)
+	}
+}
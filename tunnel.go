@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+
+	l "github.com/cinsk/triton-pssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_LISTEN_ADDRESS = "127.0.0.1"
+
+// ForwardSpec is a local port forwarding, [LPORT:]HOST:RPORT.  HOST is
+// resolved by the remote instance.  If LocalPort is zero, the local port
+// is assigned automatically.
+type ForwardSpec struct {
+	LocalPort  int
+	Host       string
+	RemotePort int
+}
+
+var regexpForward = regexp.MustCompile(`^(([0-9]+):)?(\[[^\]]+\]|[^:\[\]]+):([0-9]+)$`)
+
+func ParseForwardSpec(s string) (ForwardSpec, error) {
+	match := regexpForward.FindStringSubmatch(s)
+	if match == nil {
+		return ForwardSpec{}, fmt.Errorf("invalid forwarding %s, expected [LPORT:]HOST:RPORT", s)
+	}
+
+	spec := ForwardSpec{Host: match[3]}
+	if len(spec.Host) > 2 && spec.Host[0] == '[' {
+		spec.Host = spec.Host[1 : len(spec.Host)-1]
+	}
+	if match[2] != "" {
+		spec.LocalPort, _ = strconv.Atoi(match[2])
+	}
+	spec.RemotePort, _ = strconv.Atoi(match[4])
+
+	if spec.LocalPort > 65535 || spec.RemotePort <= 0 || spec.RemotePort > 65535 {
+		return ForwardSpec{}, fmt.Errorf("invalid port number in %s", s)
+	}
+	return spec, nil
+}
+
+func (f ForwardSpec) Remote() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(f.RemotePort))
+}
+
+// Tunnel forwards the connections to the local listeners to the remote
+// addresses through the SSH connection to the instance of a job.  The
+// connection is made again if it was dropped.
+type Tunnel struct {
+	Listeners []net.Listener // in the same order of the forwardings
+	Forwards  []ForwardSpec
+
+	session *SshSession
+	job     *SshJob
+
+	mutex        sync.Mutex
+	client       *ssh.Client
+	closer       func()
+	clientDone   chan struct{} // closed when the connection of client is closed
+	reconnecting chan struct{} // closed when the reconnection ends
+	err          error         // the error of the last reconnection
+	closed       bool
+}
+
+// OpenTunnel connects to the server of JOB, and starts listening on LISTEN
+// address for each of FORWARDS.
+func (s *SshSession) OpenTunnel(job *SshJob, listen string, forwards []ForwardSpec) (*Tunnel, error) {
+	t := &Tunnel{Forwards: forwards, session: s, job: job}
+
+	client, closer, _, err := s.connectRetry(job, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.setClient(client, closer)
+
+	for _, f := range forwards {
+		ln, err := net.Listen("tcp", net.JoinHostPort(listen, strconv.Itoa(f.LocalPort)))
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.Listeners = append(t.Listeners, ln)
+	}
+
+	for i := range t.Listeners {
+		go t.serve(t.Listeners[i], t.Forwards[i])
+	}
+	return t, nil
+}
+
+// setClient makes CLIENT the connection of the tunnel, and starts watching
+// it.  The lock must be held once the tunnel is in use.
+func (t *Tunnel) setClient(client *ssh.Client, closer func()) {
+	done := make(chan struct{})
+	t.client, t.closer, t.clientDone = client, closer, done
+	go func() {
+		err := client.Wait()
+		l.Debug("Tunnel: connection to server[%v] closed: %v", t.job.InstanceName, err)
+		close(done)
+	}()
+}
+
+func (t *Tunnel) dial(addr string) (net.Conn, error) {
+	t.mutex.Lock()
+	client, done := t.client, t.clientDone
+	t.mutex.Unlock()
+
+	if client != nil {
+		conn, err := client.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if _, ok := err.(*ssh.OpenChannelError); ok || !dropped(client, done) {
+			// the other forwardings still use the connection
+			return nil, err
+		}
+		l.Debug("Tunnel: connection to server[%v] dropped: %v", t.job.InstanceName, err)
+	}
+
+	client, err := t.reconnect(client)
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial("tcp", addr)
+}
+
+// dropped returns true if CLIENT, whose connection is watched by DONE, is
+// closed.  If it is not closed yet, a keepalive request is sent to see if
+// the connection is still usable.
+func dropped(client *ssh.Client, done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+	}
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	return err != nil
+}
+
+// reconnect makes the connection to the server again, unless the other
+// connection has replaced the dropped connection DROPPED.  The lock is
+// released while connecting, which may wait for the retry backoffs.
+func (t *Tunnel) reconnect(dropped *ssh.Client) (*ssh.Client, error) {
+	t.mutex.Lock()
+	waited := false
+	for t.reconnecting != nil {
+		wait := t.reconnecting
+		t.mutex.Unlock()
+		<-wait
+		t.mutex.Lock()
+		waited = true
+	}
+	if t.closed {
+		t.mutex.Unlock()
+		return nil, fmt.Errorf("tunnel closed")
+	}
+	if waited || (t.client != nil && t.client != dropped) {
+		// made again, or failed, by the other connection
+		client, err := t.client, t.err
+		t.mutex.Unlock()
+		if client == nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	if t.closer != nil {
+		t.closer()
+		t.client, t.closer, t.clientDone = nil, nil, nil
+	}
+	done := make(chan struct{})
+	t.reconnecting = done
+	t.mutex.Unlock()
+
+	client, closer, _, err := t.session.connectRetry(t.job, 0)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.reconnecting = nil
+	close(done)
+	if err == nil && t.closed {
+		closer()
+		err = fmt.Errorf("tunnel closed")
+	}
+	t.err = err
+	if err != nil {
+		return nil, err
+	}
+	t.setClient(client, closer)
+	return client, nil
+}
+
+func (t *Tunnel) serve(ln net.Listener, f ForwardSpec) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.Debug("Tunnel: listener %s closed: %v", ln.Addr(), err)
+			return
+		}
+		go t.forward(conn, f)
+	}
+}
+
+func (t *Tunnel) forward(conn net.Conn, f ForwardSpec) {
+	defer conn.Close()
+
+	remote, err := t.dial(f.Remote())
+	if err != nil {
+		l.Warn("cannot forward %s to %s of %s: %s", conn.RemoteAddr(), f.Remote(), t.job.InstanceName, err)
+		return
+	}
+	defer remote.Close()
+
+	l.Debug("Tunnel: forwarding %s to %s of %s", conn.RemoteAddr(), f.Remote(), t.job.InstanceName)
+	pipe(conn, remote)
+}
+
+// pipe copies the data between A and B until both directions are closed.
+func pipe(a net.Conn, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		closeWrite(a)
+		close(done)
+	}()
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+}
+
+// closeWrite shuts down the writing side of CONN if possible, so that the
+// peer gets EOF while the other direction is still in use.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+func (t *Tunnel) Close() {
+	for _, ln := range t.Listeners {
+		ln.Close()
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.closer != nil {
+		t.closer()
+		t.client, t.closer, t.clientDone = nil, nil, nil
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnel_ParseForwardSpec(env *testing.T) {
+	cases := []struct {
+		arg      string
+		expected ForwardSpec
+	}{
+		{"9999:localhost:9999", ForwardSpec{9999, "localhost", 9999}},
+		{"localhost:9999", ForwardSpec{0, "localhost", 9999}},
+		{"8080:10.0.0.5:80", ForwardSpec{8080, "10.0.0.5", 80}},
+		{"8080:[::1]:80", ForwardSpec{8080, "::1", 80}},
+	}
+	for _, c := range cases {
+		f, err := ParseForwardSpec(c.arg)
+		if err != nil {
+			env.Errorf("unexpected error for %s: %v", c.arg, err)
+		}
+		if f != c.expected {
+			env.Errorf("expected %v, got %v", c.expected, f)
+		}
+	}
+
+	for _, arg := range []string{"9999", "localhost", "a:b:c", "9999:localhost:0", "99999:localhost:80", "localhost:99999"} {
+		if _, err := ParseForwardSpec(arg); err == nil {
+			env.Errorf("expected error for %s", arg)
+		}
+	}
+}
+
+func TestTunnel_Forward(env *testing.T) {
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	// the remote service that replies "hello" and closes the connection
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	host, port, _ := net.SplitHostPort(service.Addr().String())
+	f, _ := ParseForwardSpec(host + ":" + port)
+
+	job := SshJob{Server: server.Addr(), ServerConfig: testClientConfig(), InstanceName: "test"}
+	t, err := s.OpenTunnel(&job, DEFAULT_LISTEN_ADDRESS, []ForwardSpec{f})
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	defer t.Close()
+
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// the tunnel should reconnect to the server
+			server.DropAll()
+		}
+		conn, err := net.Dial("tcp", t.Listeners[0].Addr().String())
+		if err != nil {
+			env.Fatalf("cannot connect to the tunnel: %v", err)
+		}
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(data) != "hello" {
+			env.Errorf("expected |hello|, got |%s| (err = %v)", data, err)
+		}
+	}
+}
+
+func TestTunnel_DialErrorKeepsConnection(env *testing.T) {
+	server := newTestSshServer(env)
+	defer server.Close()
+
+	// the remote service that echoes the input
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		env.Fatalf("cannot listen: %v", err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	s := NewSshSession(&TsshConfig{}, 0)
+	defer s.Close()
+
+	host, port, _ := net.SplitHostPort(service.Addr().String())
+	f, _ := ParseForwardSpec(host + ":" + port)
+
+	job := SshJob{Server: server.Addr(), ServerConfig: testClientConfig(), InstanceName: "test"}
+	t, err := s.OpenTunnel(&job, DEFAULT_LISTEN_ADDRESS, []ForwardSpec{f})
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+	defer t.Close()
+
+	conn, err := net.Dial("tcp", t.Listeners[0].Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	echo := func(msg string) {
+		conn.SetDeadline(time.Now().Add(time.Duration(5) * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			env.Fatalf("cannot write to the tunnel: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			env.Fatalf("expected |%s|, got |%s| (err = %v)", msg, buf, err)
+		}
+	}
+	echo("hello")
+
+	t.mutex.Lock()
+	client := t.client
+	t.mutex.Unlock()
+
+	// an error of a dialing that is not rejected by the server
+	if _, err := t.dial("no-port"); err == nil {
+		env.Fatalf("expected error for the invalid address")
+	}
+
+	t.mutex.Lock()
+	replaced := t.client != client
+	t.mutex.Unlock()
+	if replaced {
+		env.Errorf("the connection should not be replaced")
+	}
+	echo("world")
+}
+
+func TestTunnel_ReconnectWithoutLock(env *testing.T) {
+	server := newTestSshServer(env)
+
+	s := NewSshSession(&TsshConfig{Retries: 2, RetryBackoff: time.Duration(1) * time.Second}, 0)
+	defer s.Close()
+
+	f, _ := ParseForwardSpec("127.0.0.1:9")
+	job := SshJob{Server: server.Addr(), ServerConfig: testClientConfig(), InstanceName: "test"}
+	t, err := s.OpenTunnel(&job, DEFAULT_LISTEN_ADDRESS, []ForwardSpec{f})
+	if err != nil {
+		env.Fatalf("unexpected error: %v", err)
+	}
+
+	// the reconnection fails, and waits for the retry backoffs
+	server.Close()
+	conn, err := net.Dial("tcp", t.Listeners[0].Addr().String())
+	if err != nil {
+		env.Fatalf("cannot connect to the tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 100; i++ {
+		t.mutex.Lock()
+		reconnecting := t.reconnecting != nil
+		t.mutex.Unlock()
+		if reconnecting {
+			break
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	start := time.Now()
+	t.Close()
+	if elapsed := time.Since(start); elapsed > time.Duration(500)*time.Millisecond {
+		env.Errorf("Close() waited %v for the reconnection", elapsed)
+	}
+}